@@ -16,7 +16,13 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"runtime"
+	"strings"
 
+	"github.com/moloch--/denim/pkg/assets"
+	"github.com/moloch--/denim/pkg/build"
+	"github.com/moloch--/denim/pkg/config"
+	"github.com/moloch--/denim/pkg/logger"
 	"github.com/spf13/cobra"
 )
 
@@ -37,24 +43,48 @@ const (
 	downN     = "\033[%dB"
 	underline = "\033[4m"
 
-	// Info - Display colorful information
-	Info = bold + cyan + "[*] " + normal
-	// Warn - Warn a user
-	Warn = bold + red + "[!] " + normal
-	// Debug - Display debug information
-	Debug = bold + purple + "[-] " + normal
-	// Woot - Display success
-	Woot = bold + green + "[$] " + normal
+	// Global Flags, --output is taken by compile's output file
+	outputFormatFlagStr = "output-format"
+	logLevelFlagStr     = "log-level"
+	noColorFlagStr      = "no-color"
 
 	// Setup - Standard Flags
 	timeoutFlagStr           = "timeout"
 	skipTLSValidationFlagStr = "skip-tls-validation"
 	proxyFlagStr             = "proxy"
+	ollvmURLFlagStr          = "ollvm-url"
 
 	// Compile - Standard Flags
-	outputFlagStr  = "output"
-	allCodeFlagStr = "all"
-	verboseFlagStr = "verbose"
+	outputFlagStr    = "output"
+	allCodeFlagStr   = "all"
+	ruleFlagStr      = "rule"
+	jobsFlagStr      = "jobs"
+	noCacheFlagStr   = "no-cache"
+	resourceFlagStr  = "resource"
+	keepWorkFlagStr  = "keep-workspace"
+	emitDirFlagStr   = "emit-dir"
+	emitIRFlagStr    = "emit-ir"
+	wholeProgFlagStr = "whole-program"
+	defineFlagStr    = "define"
+	configFlagStr    = "config"
+	profileFlagStr   = "profile"
+	cFlagsFlagStr    = "cflags"
+	ldFlagsFlagStr   = "ldflags"
+	verboseFlagStr   = "verbose"
+	targetFlagStr    = "target"
+	sysrootFlagStr   = "sysroot"
+
+	// Compile - Library Flags
+	appFlagStr          = "app"
+	defFileFlagStr      = "def"
+	exportFlagStr       = "export"
+	stripNimMainFlagStr = "strip-nim-main"
+
+	// Toolchain - Flags
+	clangDirFlagStr  = "clang-dir"
+	toolchainFlagStr = "toolchain"
+	urlFlagStr       = "url"
+	projectFlagStr   = "project"
 
 	// Compile - Obfuscation Flags
 	bcfFlagStr      = "bcf"
@@ -65,6 +95,10 @@ const (
 	flattenFlagStr  = "flatten"
 	flattenSplitStr = "flatten-split"
 	seedFlagStr     = "seed"
+	strCryFlagStr   = "strcry"
+	constEncFlagStr = "constenc"
+	pipelineFlagStr = "pipeline"
+	presetFlagStr   = "preset"
 )
 
 var rootCmd = &cobra.Command{
@@ -74,20 +108,32 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 
 	},
+	PersistentPreRunE: initOutput,
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		finishOutput()
+	},
 }
 
 func init() {
 
+	// Global
+	rootCmd.PersistentFlags().String(outputFormatFlagStr, outputText, fmt.Sprintf("output format (%s, %s), json prints one event per line and a result", outputText, outputJSON))
+	rootCmd.PersistentFlags().String(logLevelFlagStr, logger.InfoLevel.String(), fmt.Sprintf("minimum level displayed (%s), build logs record everything", strings.Join(logger.LevelNames(), ", ")))
+	rootCmd.PersistentFlags().Bool(noColorFlagStr, false, "disable colors (default when not a terminal or $NO_COLOR is set)")
+
 	// Version
+	versionCmd.Flags().StringP(clangDirFlagStr, "c", "", "obfuscator toolchain directory (default is $"+assets.ClangDirEnvVar+" or denim's)")
 	rootCmd.AddCommand(versionCmd)
 
 	// Setup options
 	setupCmd.Flags().BoolP(skipTLSValidationFlagStr, "V", false, "Skip TLS certificate validation")
 	setupCmd.Flags().StringP(proxyFlagStr, "H", "", "Specify HTTP(S) proxy URL (e.g. http://localhost:8080)")
 	setupCmd.Flags().IntP(timeoutFlagStr, "T", 3600, "HTTPS request/connection timeout (default: 1hr)")
+	setupCmd.Flags().StringP(ollvmURLFlagStr, "O", "", "Override obfuscator-llvm download URL (.tar.gz)")
 	rootCmd.AddCommand(setupCmd)
 
 	// Compile - Obfuscator options
+	compileCmd.Flags().StringP(presetFlagStr, "x", "", fmt.Sprintf("obfuscation preset (%s), flags override its values", strings.Join(build.PresetNames(), ", ")))
 	compileCmd.Flags().BoolP(bcfFlagStr, "b", true, "Enable bogus control flow")
 	compileCmd.Flags().IntP(bcfLoopFlagStr, "C", 0, "Number of bogus control flow passes (0 = random)")
 	compileCmd.Flags().IntP(bcfProbFlagStr, "F", 100, "Probability a basic bloc will be obfuscated")
@@ -96,19 +142,68 @@ func init() {
 	compileCmd.Flags().BoolP(flattenFlagStr, "f", true, "Enable control flow flattening")
 	compileCmd.Flags().IntP(flattenSplitStr, "L", 0, "Splits applied to each block (0 = random)")
 	compileCmd.Flags().StringP(seedFlagStr, "r", "", "PRNG obfuscation seed (default is random)")
+	compileCmd.Flags().BoolP(strCryFlagStr, "e", false, "Enable string encryption (toolchain must support it)")
+	compileCmd.Flags().BoolP(constEncFlagStr, "k", false, "Enable constant encryption (toolchain must support it)")
+	compileCmd.Flags().StringP(pipelineFlagStr, "P", "", "run passes in this order with opt e.g. sub:2,fla,bcf (overrides --bcf/--sub/--flatten)")
 
 	// Compile - Standard options
 	compileCmd.Flags().StringP(outputFlagStr, "o", "", "output file")
+	compileCmd.Flags().StringArrayP(defineFlagStr, "d", []string{}, "nim define e.g. ssl or key=value")
+	compileCmd.Flags().StringArray(cFlagsFlagStr, []string{}, "extra clang flags for every C file e.g. \"-DDEBUG -O2\"")
+	compileCmd.Flags().StringArray(ldFlagsFlagStr, []string{}, "extra clang flags for the link e.g. \"-static -lssl\"")
+	compileCmd.Flags().String(configFlagStr, "", "project config file (default is ./"+config.ProjectConfigFile+" if it exists)")
+	compileCmd.Flags().StringP(profileFlagStr, "p", "", "project config profile e.g. release")
 	compileCmd.Flags().BoolP(allCodeFlagStr, "a", false, "obfuscate all code including nim stdlib")
-	compileCmd.Flags().BoolP(verboseFlagStr, "v", false, "display verbose information")
+	compileCmd.Flags().StringArrayP(ruleFlagStr, "R", []string{}, "per-module obfuscation rule <glob>=<none|default|max|bcf[:n],sub[:n],fla[:n]> (first match wins)")
+	compileCmd.Flags().BoolP(verboseFlagStr, "v", false, "display nim and clang output (same as --log-level debug)")
+	compileCmd.Flags().IntP(jobsFlagStr, "j", runtime.NumCPU(), "number of C files to compile in parallel")
+	compileCmd.Flags().BoolP(noCacheFlagStr, "N", false, "do not use the object cache (~/.denim/cache)")
+	compileCmd.Flags().BoolP(wholeProgFlagStr, "w", false, "merge all C code with llvm-link and obfuscate it as one module")
+	compileCmd.Flags().BoolP(keepWorkFlagStr, "K", false, "keep the build workspace (nimcache) after a successful build")
+	compileCmd.Flags().StringP(emitDirFlagStr, "X", "", "copy C sources, nim JSON, clang commands, and objects to a directory")
+	compileCmd.Flags().BoolP(emitIRFlagStr, "I", false, "also emit LLVM IR before and after obfuscation (requires --emit-dir)")
+	compileCmd.Flags().StringArrayP(resourceFlagStr, "W", []string{}, "windows resource (.rc/.res) to link e.g. icons, version info, manifests")
+	compileCmd.Flags().StringP(appFlagStr, "A", build.AppConsole, fmt.Sprintf("application type (%s)", strings.Join(build.AppTypes, ", ")))
+	compileCmd.Flags().StringP(defFileFlagStr, "D", "", "library exports .def file (--app lib)")
+	compileCmd.Flags().StringSliceP(exportFlagStr, "E", []string{}, "library exported symbols (--app lib)")
+	compileCmd.Flags().BoolP(stripNimMainFlagStr, "M", false, "do not export NimMain from the library (--app lib)")
+	compileCmd.Flags().StringP(targetFlagStr, "t", "", "target os/arch e.g. windows/amd64 (default is the host)")
+	compileCmd.Flags().StringP(sysrootFlagStr, "S", "", "target sysroot (default is auto-detected)")
+	compileCmd.Flags().StringP(clangDirFlagStr, "c", "", "obfuscator toolchain directory (default is $"+assets.ClangDirEnvVar+" or denim's)")
+	compileCmd.Flags().StringSlice(toolchainFlagStr, []string{}, "pin toolchain(s) for this build e.g. ollvm-9.0.1")
 	rootCmd.AddCommand(compileCmd)
 
+	// Toolchain
+	toolchainInstallCmd.Flags().StringP(urlFlagStr, "u", "", "download URL of the toolchain archive")
+	toolchainInstallCmd.Flags().BoolP(skipTLSValidationFlagStr, "V", false, "Skip TLS certificate validation")
+	toolchainInstallCmd.Flags().StringP(proxyFlagStr, "H", "", "Specify HTTP(S) proxy URL (e.g. http://localhost:8080)")
+	toolchainInstallCmd.Flags().IntP(timeoutFlagStr, "T", 3600, "HTTPS request/connection timeout (default: 1hr)")
+	toolchainCmd.AddCommand(toolchainInstallCmd)
+	toolchainUseCmd.Flags().BoolP(projectFlagStr, "p", false, "pin the toolchain for the project in the current directory")
+	toolchainCmd.AddCommand(toolchainUseCmd)
+	toolchainCmd.AddCommand(toolchainListCmd)
+	toolchainCmd.AddCommand(toolchainRemoveCmd)
+	toolchainCmd.AddCommand(toolchainInfoCmd)
+	rootCmd.AddCommand(toolchainCmd)
+
+	// Doctor
+	doctorCmd.Flags().StringP(clangDirFlagStr, "c", "", "obfuscator toolchain directory (default is $"+assets.ClangDirEnvVar+" or denim's)")
+	rootCmd.AddCommand(doctorCmd)
+
 }
 
 // Execute - Execute the root command
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		if isJSON() {
+			printError("%s\n", err)
+			finishOutput()
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+	if 0 < len(output.Errors) {
 		os.Exit(1)
 	}
 }
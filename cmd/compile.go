@@ -15,108 +15,441 @@ package cmd
 
 import (
 	"fmt"
-	"math/rand"
+	"os"
 	"path/filepath"
-	"time"
+	"runtime"
+	"strings"
 
 	"github.com/moloch--/denim/pkg/assets"
 	"github.com/moloch--/denim/pkg/build"
+	"github.com/moloch--/denim/pkg/logger"
 	"github.com/moloch--/denim/pkg/nim"
 	"github.com/moloch--/denim/pkg/ollvm"
 	"github.com/spf13/cobra"
 )
 
 var compileCmd = &cobra.Command{
-	Use:   "compile",
+	Use:   "compile <nim files> [-- <nim args>]",
 	Short: "Compile a nim program",
-	Long:  `Compile a nim program with obfuscator-llvm`,
+	Long:  `Compile a nim program with obfuscator-llvm, arguments after -- are passed to nim`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if !preflight() {
+		nimArgs := []string{}
+		if dash := cmd.ArgsLenAtDash(); 0 <= dash {
+			nimArgs = args[dash:]
+			args = args[:dash]
+		}
+		args, err := loadProjectConfig(cmd, args)
+		if err != nil {
+			return
+		}
+		logPath := openBuildLog(args)
+		defer closeBuildLog(logPath)
+		preset, err := applyPreset(cmd)
+		if err != nil {
+			return
+		}
+		if preset != nil {
+			setResult("preset", preset.Name)
+		}
+		toolchains, err := cmd.Flags().GetStringSlice(toolchainFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", toolchainFlagStr, err)
+			return
+		}
+		err = assets.PinToolchains(toolchains)
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		clangDir, err := getClangDir(cmd)
+		if err != nil {
+			return
+		}
+		clang := preflight(clangDir)
+		if clang == nil {
 			return
 		}
 		if len(args) < 1 {
-			fmt.Printf(Warn + "Missing input files\n")
+			printError("Missing input files\n")
 			return
 		}
 
 		allCode, err := cmd.Flags().GetBool(allCodeFlagStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", allCodeFlagStr, err)
+			printError("Failed to parse --%s flag: %s\n", allCodeFlagStr, err)
 			return
 		}
 		output, err := cmd.Flags().GetString(outputFlagStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", outputFlagStr, err)
+			printError("Failed to parse --%s flag: %s\n", outputFlagStr, err)
+			return
+		}
+		defines, err := cmd.Flags().GetStringArray(defineFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", defineFlagStr, err)
+			return
+		}
+		cFlags, err := getFlagFields(cmd, cFlagsFlagStr)
+		if err != nil {
+			return
+		}
+		ldFlags, err := getFlagFields(cmd, ldFlagsFlagStr)
+		if err != nil {
 			return
 		}
 		verbose, err := cmd.Flags().GetBool(verboseFlagStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", verboseFlagStr, err)
+			printError("Failed to parse --%s flag: %s\n", verboseFlagStr, err)
+			return
+		}
+		if verbose && !cmd.Flags().Changed(logLevelFlagStr) {
+			logger.SetLevel(logger.DebugLevel)
+		}
+		jobs, err := cmd.Flags().GetInt(jobsFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", jobsFlagStr, err)
+			return
+		}
+		noCache, err := cmd.Flags().GetBool(noCacheFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", noCacheFlagStr, err)
+			return
+		}
+		keepWorkspace, err := cmd.Flags().GetBool(keepWorkFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", keepWorkFlagStr, err)
+			return
+		}
+		wholeProgram, err := cmd.Flags().GetBool(wholeProgFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", wholeProgFlagStr, err)
 			return
 		}
+		emitDir, err := cmd.Flags().GetString(emitDirFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", emitDirFlagStr, err)
+			return
+		}
+		if emitDir != "" {
+			emitDir, err = filepath.Abs(emitDir)
+			if err != nil {
+				printError("%s\n", err)
+				return
+			}
+		}
+		emitIR, err := cmd.Flags().GetBool(emitIRFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", emitIRFlagStr, err)
+			return
+		}
+		if emitIR && emitDir == "" {
+			printError("--%s requires --%s\n", emitIRFlagStr, emitDirFlagStr)
+			return
+		}
+		resources, err := cmd.Flags().GetStringArray(resourceFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", resourceFlagStr, err)
+			return
+		}
+		app, err := cmd.Flags().GetString(appFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", appFlagStr, err)
+			return
+		}
+		if !isValidApp(app) {
+			printError("Invalid --%s '%s' (valid types: %s)\n", appFlagStr, app, strings.Join(build.AppTypes, ", "))
+			return
+		}
+		defFile, err := cmd.Flags().GetString(defFileFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", defFileFlagStr, err)
+			return
+		}
+		if defFile != "" {
+			defFile, err = filepath.Abs(defFile)
+			if err != nil {
+				printError("%s\n", err)
+				return
+			}
+		}
+		exports, err := cmd.Flags().GetStringSlice(exportFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", exportFlagStr, err)
+			return
+		}
+		stripNimMain, err := cmd.Flags().GetBool(stripNimMainFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", stripNimMainFlagStr, err)
+			return
+		}
+		if app != build.AppLib && (defFile != "" || 0 < len(exports) || stripNimMain) {
+			printError("--%s, --%s, and --%s require --%s %s\n", defFileFlagStr, exportFlagStr, stripNimMainFlagStr, appFlagStr, build.AppLib)
+			return
+		}
+		targetName, err := cmd.Flags().GetString(targetFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", targetFlagStr, err)
+			return
+		}
+		sysroot, err := cmd.Flags().GetString(sysrootFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", sysrootFlagStr, err)
+			return
+		}
+		target, err := build.GetTarget(targetName, sysroot)
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		setResult("target", target.Name)
 		buildArgs := &build.Build{
 			Name:       filepath.Base(args[0]),
 			NimFiles:   args,
 			Output:     output,
+			Defines:    defines,
+			NimArgs:    nimArgs,
+			CFlags:     cFlags,
+			LDFlags:    ldFlags,
 			ObfAllCode: allCode,
-			Verbose:    verbose,
+			Target:     target,
+			ClangDir:   clangDir,
+			Jobs:       jobs,
+			NoCache:    noCache,
+			Resources:  resources,
+
+			WholeProgram: wholeProgram,
+
+			App:          app,
+			DefFile:      defFile,
+			Exports:      exports,
+			StripNimMain: stripNimMain,
+
+			KeepWorkspace: keepWorkspace,
+			EmitDir:       emitDir,
+			EmitIR:        emitIR,
 		}
 
 		obfArgs, err := getObfArgs(cmd)
 		if err != nil {
 			return
 		}
+		ruleSpecs, err := cmd.Flags().GetStringArray(ruleFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", ruleFlagStr, err)
+			return
+		}
+		if wholeProgram && 0 < len(ruleSpecs) {
+			printWarn("--%s obfuscates all code as one module, ignoring --%s\n", wholeProgFlagStr, ruleFlagStr)
+			ruleSpecs = []string{}
+		}
+		if preset != nil && !wholeProgram {
+			ruleSpecs = append(ruleSpecs, preset.Rules...)
+		}
+		for _, spec := range ruleSpecs {
+			rule, err := build.ParseRule(spec, obfArgs)
+			if err != nil {
+				printError("%s\n", err)
+				return
+			}
+			buildArgs.ObfRules = append(buildArgs.ObfRules, rule)
+		}
+		for _, option := range clang.Unsupported(obfArgs) {
+			printWarn("Toolchain (%s) does not support -%s, ignoring\n", clang.Capabilities.Flavor, option)
+		}
 
-		err = build.Compile(buildArgs, obfArgs)
+		result, err := build.Compile(buildArgs, clang, obfArgs)
 		if err != nil {
-			fmt.Printf(Warn+"%s", err)
+			printError("%s\n", err)
+			return
 		}
+		setResult("build", result)
 	},
 }
 
-func preflight() bool {
-	_, err := nim.Version()
+// openBuildLog - Record everything about this build (including each command
+// nim and clang run) in a new log under ~/.denim/logs
+func openBuildLog(args []string) string {
+	name := "build"
+	if 0 < len(args) {
+		name = strings.TrimSuffix(filepath.Base(args[0]), filepath.Ext(args[0]))
+	}
+	logPath, err := logger.OpenFile(assets.GetLogsDir(), name)
+	if err != nil {
+		printWarn("Failed to create build log: %s\n", err)
+		return ""
+	}
+	setResult("log", logPath)
+	cwd, _ := os.Getwd()
+	logger.Record(logger.InfoLevel, "denim v%s (%s/%s)\nargv: %s\ndir: %s\nenv: %s",
+		Version, runtime.GOOS, runtime.GOARCH, strings.Join(os.Args, " "), cwd, strings.Join(os.Environ(), "\nenv: "))
+	return logPath
+}
+
+// closeBuildLog - Point the user at the build log when the build failed
+func closeBuildLog(logPath string) {
+	if logPath == "" {
+		return
+	}
+	if hasErrors() {
+		printInfo("Build log: %s\n", logPath)
+	} else {
+		printDebug("Build log: %s\n", logPath)
+	}
+	logger.CloseFile()
+}
+
+// applyPreset - Set the pass options of --preset that weren't given as flags
+func applyPreset(cmd *cobra.Command) (*build.Preset, error) {
+	name, err := cmd.Flags().GetString(presetFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", presetFlagStr, err)
+		return nil, err
+	}
+	if name == "" {
+		return nil, nil
+	}
+	preset, err := build.GetPreset(name)
+	if err != nil {
+		printError("%s\n", err)
+		return nil, err
+	}
+	err = setUnchangedFlags(cmd, presetFlags(preset), fmt.Sprintf("preset %s", name))
+	if err != nil {
+		return nil, err
+	}
+	return preset, nil
+}
+
+// getFlagFields - Each value of a flag can hold several space separated args
+func getFlagFields(cmd *cobra.Command, flagStr string) ([]string, error) {
+	values, err := cmd.Flags().GetStringArray(flagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", flagStr, err)
+		return nil, err
+	}
+	fields := []string{}
+	for _, value := range values {
+		fields = append(fields, strings.Fields(value)...)
+	}
+	return fields, nil
+}
+
+func isValidApp(app string) bool {
+	for _, appType := range build.AppTypes {
+		if app == appType {
+			return true
+		}
+	}
+	return false
+}
+
+func preflight(clangDir string) *ollvm.Clang {
+	nimVersion, err := nim.Version()
+	if err != nil {
+		printError("Could not find nim on PATH, run 'denim doctor' for details\n")
+		return nil
+	}
+	if version, err := nim.ParseVersion(nimVersion); err == nil {
+		setResult("nim", version)
+	}
+	clang, err := ollvm.InitClang(clangDir)
+	if err != nil {
+		printError("No obfuscator-llvm found in %s, you probably need to run 'denim setup' (or 'denim doctor' for details)\n", clangDir)
+		return nil
+	}
+	capabilities, err := clang.Probe()
+	if err != nil {
+		printError("Failed to probe obfuscator toolchain %s, run 'denim doctor' for details\n", err)
+		return nil
+	}
+	setResult("capabilities", capabilities)
+	return clang
+}
+
+// getClangDir - The --clang-dir flag, then $DENIM_CLANG_DIR, then ours
+func getClangDir(cmd *cobra.Command) (string, error) {
+	clangDir, err := resolveClangDir(cmd)
 	if err != nil {
-		fmt.Printf(Warn + "Could not find nim on PATH\n")
-		return false
+		printError("%s\n", err)
 	}
-	_, err = ollvm.InitClang(assets.GetClangDir())
+	return clangDir, err
+}
+
+// resolveClangDir - getClangDir without displaying the error
+func resolveClangDir(cmd *cobra.Command) (string, error) {
+	clangDir, err := cmd.Flags().GetString(clangDirFlagStr)
 	if err != nil {
-		fmt.Printf(Warn + "No obfuscator-llvm found, you probably need to run 'denim setup'\n")
-		return false
+		return "", fmt.Errorf("Failed to parse --%s flag: %s", clangDirFlagStr, err)
+	}
+	if clangDir != "" && assets.IsPinned(assets.OLLVMToolchain) {
+		return "", fmt.Errorf("--%s and an ollvm --%s are mutually exclusive", clangDirFlagStr, toolchainFlagStr)
+	}
+	if clangDir == "" {
+		return assets.GetClangDir()
 	}
-	return true
+	return clangDir, nil
 }
 
 func getObfArgs(cmd *cobra.Command) (*ollvm.ObfArgs, error) {
 	obfArgs := &ollvm.ObfArgs{}
-	rand.Seed(time.Now().UTC().UnixNano())
+
+	// Every random choice is derived from the seed, so a build can be reproduced
+	seed, err := cmd.Flags().GetString(seedFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", seedFlagStr, err)
+		return nil, err
+	}
+	if seed == "" {
+		seed = ollvm.RandomSeed()
+		printInfo("Obfuscation seed: %s\n", seed)
+	}
+	obfArgs.AESSeed = seed
+	setResult("seed", seed)
+	prng := ollvm.NewPRNG(seed)
+
+	// A pipeline decides which passes run
+	pipeline, err := cmd.Flags().GetString(pipelineFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", pipelineFlagStr, err)
+		return nil, err
+	}
+	if pipeline != "" {
+		obfArgs.Pipeline, err = ollvm.ParsePipeline(pipeline)
+		if err != nil {
+			printError("%s\n", err)
+			return nil, err
+		}
+		printDebug("Pipeline: %s\n", ollvm.PipelineString(obfArgs.Pipeline))
+	}
 
 	bcfEnabled, err := cmd.Flags().GetBool(bcfFlagStr)
 	if err != nil {
-		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", bcfFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", bcfFlagStr, err)
 		return nil, err
 	}
+	if obfArgs.Pipeline != nil {
+		bcfEnabled = ollvm.PipelineHas(obfArgs.Pipeline, ollvm.OptBCF)
+	}
 	if bcfEnabled {
 		obfArgs.BCF = bcfEnabled
 
 		bcfLoops, err := cmd.Flags().GetInt(bcfLoopFlagStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", bcfLoopFlagStr, err)
+			printError("Failed to parse --%s flag: %s\n", bcfLoopFlagStr, err)
 			return nil, err
 		}
 		if bcfLoops < 1 {
-			bcfLoops = rand.Intn(4) + 1
+			bcfLoops = prng.Intn(4) + 1
 		}
 		obfArgs.BCFLoop = bcfLoops
 
 		bcfProb, err := cmd.Flags().GetInt(bcfProbFlagStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", bcfProbFlagStr, err)
+			printError("Failed to parse --%s flag: %s\n", bcfProbFlagStr, err)
 			return nil, err
 		}
 		if 100 < bcfProb {
-			fmt.Printf(Info + "Max BCF probability set to 100\n")
+			printInfo("Max BCF probability set to 100\n")
 			bcfProb = 100
 		}
 		obfArgs.BCFProb = bcfProb
@@ -124,48 +457,61 @@ func getObfArgs(cmd *cobra.Command) (*ollvm.ObfArgs, error) {
 
 	subEnabled, err := cmd.Flags().GetBool(subFlagStr)
 	if err != nil {
-		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", subFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", subFlagStr, err)
 		return nil, err
 	}
+	if obfArgs.Pipeline != nil {
+		subEnabled = ollvm.PipelineHas(obfArgs.Pipeline, ollvm.OptSub)
+	}
 	if subEnabled {
 		obfArgs.Sub = subEnabled
 
 		subLoops, err := cmd.Flags().GetInt(subLoopFlagStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", subLoopFlagStr, err)
+			printError("Failed to parse --%s flag: %s\n", subLoopFlagStr, err)
 			return nil, err
 		}
 		if subLoops < 1 {
-			subLoops = rand.Intn(2) + 1
+			subLoops = prng.Intn(2) + 1
 		}
 		obfArgs.SubLoop = subLoops
 	}
 
 	flattenEnabled, err := cmd.Flags().GetBool(flattenFlagStr)
 	if err != nil {
-		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", flattenFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", flattenFlagStr, err)
 		return nil, err
 	}
+	if obfArgs.Pipeline != nil {
+		flattenEnabled = ollvm.PipelineHas(obfArgs.Pipeline, ollvm.OptFlatten) || ollvm.PipelineHas(obfArgs.Pipeline, ollvm.OptSplit)
+	}
 	if flattenEnabled {
 		obfArgs.Flatten = flattenEnabled
 
 		splits, err := cmd.Flags().GetInt(flattenSplitStr)
 		if err != nil {
-			fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", flattenSplitStr, err)
+			printError("Failed to parse --%s flag: %s\n", flattenSplitStr, err)
 			return nil, err
 		}
 		if splits < 1 {
-			splits = rand.Intn(4) + 1
+			splits = prng.Intn(4) + 1
 		}
 		obfArgs.FlattenSplit = splits
 	}
 
-	seed, err := cmd.Flags().GetString(seedFlagStr)
+	strCry, err := cmd.Flags().GetBool(strCryFlagStr)
 	if err != nil {
-		fmt.Printf(Warn+"Failed to parse --%s flag: %s\n", seedFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", strCryFlagStr, err)
 		return nil, err
 	}
-	obfArgs.AESSeed = seed
+	obfArgs.StringEncryption = strCry
+
+	constEnc, err := cmd.Flags().GetBool(constEncFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", constEncFlagStr, err)
+		return nil, err
+	}
+	obfArgs.ConstantEncryption = constEnc
 
 	return obfArgs, nil
 }
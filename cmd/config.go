@@ -0,0 +1,162 @@
+package cmd
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/moloch--/denim/pkg/build"
+	"github.com/moloch--/denim/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// loadProjectConfig - Apply the project's denim.toml (and --profile) to the
+// flags that weren't given, flags always win. Returns the input files, the
+// config's files are only used if none were given.
+func loadProjectConfig(cmd *cobra.Command, args []string) ([]string, error) {
+	configPath, err := cmd.Flags().GetString(configFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", configFlagStr, err)
+		return nil, err
+	}
+	profile, err := cmd.Flags().GetString(profileFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", profileFlagStr, err)
+		return nil, err
+	}
+	if configPath == "" {
+		configPath = config.ProjectConfigFile
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			if profile != "" {
+				err = fmt.Errorf("--%s requires a %s", profileFlagStr, config.ProjectConfigFile)
+				printError("%s\n", err)
+				return nil, err
+			}
+			return args, nil
+		}
+	}
+	projectConfig, err := config.Load(configPath)
+	if err != nil {
+		printError("%s\n", err)
+		return nil, err
+	}
+	settings, err := projectConfig.Profile(profile)
+	if err != nil {
+		printError("%s\n", err)
+		return nil, err
+	}
+	if profile != "" {
+		printInfo("Using profile %s from %s\n", profile, configPath)
+		setResult("profile", profile)
+	}
+
+	err = setUnchangedFlags(cmd, settingsFlags(settings), configPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return settings.Files, nil
+	}
+	return args, nil
+}
+
+// setUnchangedFlags - Set flags the user didn't give, a list flag the user
+// gave isn't added to
+func setUnchangedFlags(cmd *cobra.Command, flags [][2]string, source string) error {
+	changed := map[string]bool{}
+	for _, flag := range flags {
+		name, value := flag[0], flag[1]
+		if _, ok := changed[name]; !ok {
+			changed[name] = cmd.Flags().Changed(name)
+		}
+		if changed[name] {
+			continue
+		}
+		err := cmd.Flags().Set(name, value)
+		if err != nil {
+			err = fmt.Errorf("Invalid %s value '%s' in %s: %s", name, value, source, err)
+			printError("%s\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// settingsFlags - Settings as compile flag name/value pairs in a stable
+// order, lists are one pair per item
+func settingsFlags(settings *config.Settings) [][2]string {
+	flags := [][2]string{}
+	addList := func(name string, values []string) {
+		for _, value := range values {
+			flags = append(flags, [2]string{name, value})
+		}
+	}
+	addString := func(name string, value *string) {
+		if value != nil {
+			flags = append(flags, [2]string{name, *value})
+		}
+	}
+	addBool := func(name string, value *bool) {
+		if value != nil {
+			flags = append(flags, [2]string{name, fmt.Sprintf("%t", *value)})
+		}
+	}
+	addInt := func(name string, value *int) {
+		if value != nil {
+			flags = append(flags, [2]string{name, fmt.Sprintf("%d", *value)})
+		}
+	}
+	addString(outputFlagStr, settings.Output)
+	addList(toolchainFlagStr, settings.Toolchain)
+	addString(targetFlagStr, settings.Target)
+	addString(appFlagStr, settings.App)
+	addList(defineFlagStr, settings.Defines)
+	addList(resourceFlagStr, settings.Resources)
+	addList(cFlagsFlagStr, settings.CFlags)
+	addList(ldFlagsFlagStr, settings.LDFlags)
+
+	obf := settings.Obfuscation
+	addString(presetFlagStr, obf.Preset)
+	addBool(bcfFlagStr, obf.BCF)
+	addInt(bcfLoopFlagStr, obf.BCFLoop)
+	addInt(bcfProbFlagStr, obf.BCFProbability)
+	addBool(subFlagStr, obf.Sub)
+	addInt(subLoopFlagStr, obf.SubLoop)
+	addBool(flattenFlagStr, obf.Flatten)
+	addInt(flattenSplitStr, obf.FlattenSplit)
+	addString(seedFlagStr, obf.Seed)
+	addBool(strCryFlagStr, obf.StrCry)
+	addBool(constEncFlagStr, obf.ConstEnc)
+	addString(pipelineFlagStr, obf.Pipeline)
+	addBool(wholeProgFlagStr, obf.WholeProgram)
+	addBool(allCodeFlagStr, obf.All)
+	addList(ruleFlagStr, obf.Rules)
+	return flags
+}
+
+// presetFlags - A preset's pass options as compile flag name/value pairs
+func presetFlags(preset *build.Preset) [][2]string {
+	obfArgs := preset.ObfArgs
+	return [][2]string{
+		{bcfFlagStr, fmt.Sprintf("%t", obfArgs.BCF)},
+		{bcfLoopFlagStr, fmt.Sprintf("%d", obfArgs.BCFLoop)},
+		{bcfProbFlagStr, fmt.Sprintf("%d", obfArgs.BCFProb)},
+		{subFlagStr, fmt.Sprintf("%t", obfArgs.Sub)},
+		{subLoopFlagStr, fmt.Sprintf("%d", obfArgs.SubLoop)},
+		{flattenFlagStr, fmt.Sprintf("%t", obfArgs.Flatten)},
+		{flattenSplitStr, fmt.Sprintf("%d", obfArgs.FlattenSplit)},
+		{allCodeFlagStr, fmt.Sprintf("%t", preset.AllCode)},
+	}
+}
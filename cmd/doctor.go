@@ -0,0 +1,414 @@
+package cmd
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/assets"
+	"github.com/moloch--/denim/pkg/build"
+	"github.com/moloch--/denim/pkg/nim"
+	"github.com/moloch--/denim/pkg/ollvm"
+	"github.com/moloch--/denim/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// minFreeSpace - A toolchain is ~1GB unpacked, and builds need room for
+	// their workspaces and the object cache
+	minFreeSpace = 2 * 1024 * 1024 * 1024
+
+	doctorProgram = `int fib(int n) {
+	int a = 0, b = 1;
+	for (int i = 0; i < n; i++) {
+		int t = a + b;
+		a = b;
+		b = t;
+	}
+	return a;
+}
+
+int main(void) {
+	return fib(10) == 55 ? 0 : 1;
+}
+`
+)
+
+var (
+	clangVersionRegex = regexp.MustCompile(`clang version (\d+\.\d+\.\d+)`)
+
+	// knownBadVersions - Nim/clang version combinations that break denim
+	// builds, each bound is [min, below) and an empty bound matches any version
+	knownBadVersions = []*badVersions{
+		{
+			NimBelow: "1.0.0",
+			Reason:   "denim reads nim's --genScript build instructions, which need nim 1.0 or later",
+		},
+		{
+			ClangBelow: "4.0.0",
+			Reason:     "--pipeline and --whole-program need clang 4.0 or later (-disable-llvm-passes)",
+		},
+		{
+			NimBelow: "1.6.12",
+			ClangMin: "16.0.0",
+			Reason:   "clang 16 made -Wincompatible-function-pointer-types an error and older nim generates C that triggers it",
+			Hint:     "Upgrade nim, or add --cflags -Wno-error=incompatible-function-pointer-types",
+		},
+	}
+)
+
+// badVersions - A range of nim and clang versions that don't work together
+type badVersions struct {
+	NimMin     string
+	NimBelow   string
+	ClangMin   string
+	ClangBelow string
+	Reason     string
+	Hint       string
+}
+
+// Matches - Check if the versions are in the range, an unknown version
+// never matches a bounded range
+func (b *badVersions) Matches(nimVersion string, clangVersion string) bool {
+	return inVersionRange(nimVersion, b.NimMin, b.NimBelow) && inVersionRange(clangVersion, b.ClangMin, b.ClangBelow)
+}
+
+func inVersionRange(version string, min string, below string) bool {
+	if min == "" && below == "" {
+		return true
+	}
+	if version == "" {
+		return false
+	}
+	if min != "" && compareVersions(version, min) < 0 {
+		return false
+	}
+	return below == "" || compareVersions(version, below) < 0
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the nim and obfuscator toolchains",
+	Long:  `Check that nim, the obfuscator toolchain, and mingw work, and that ~/.denim is usable`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := &doctor{}
+		nimVersion := d.checkNim()
+		d.checkDenimDir()
+
+		var clang *ollvm.Clang
+		clangVersion := ""
+		clangDir, err := resolveClangDir(cmd)
+		if err != nil {
+			d.problem("Install the toolchain or pin an installed one, see 'denim toolchain list'", "%s", err)
+		} else {
+			clang, clangVersion = d.checkClang(clangDir)
+		}
+		d.checkMingw()
+		if clang != nil {
+			d.checkCompile(clang)
+		}
+		d.checkVersions(nimVersion, clangVersion)
+
+		setResult("checks", d.checks)
+		setResult("problems", d.problems)
+		printText("\n")
+		if d.problems == 0 {
+			printWoot("No problems found\n")
+		} else {
+			printError("%d problem(s) found\n", d.problems)
+		}
+	},
+}
+
+// doctor - Displays the result of each check and counts the problems
+type doctor struct {
+	problems int
+	checks   []*doctorCheck
+}
+
+type doctorCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	d.checks = append(d.checks, &doctorCheck{OK: true, Message: fmt.Sprintf(format, args...)})
+	printInfo(format+"\n", args...)
+}
+
+func (d *doctor) problem(hint string, format string, args ...interface{}) {
+	d.problems++
+	d.checks = append(d.checks, &doctorCheck{Message: fmt.Sprintf(format, args...), Hint: hint})
+	printWarn(format+"\n", args...)
+	if hint != "" {
+		printText("    %s\n", hint)
+	}
+}
+
+// checkNim - Nim is on the PATH and reports a version
+func (d *doctor) checkNim() string {
+	nimPath, err := exec.LookPath(nim.Nim)
+	if err != nil {
+		d.problem("Install nim (https://nim-lang.org/install.html) and add its bin directory to your PATH", "Could not find %s on PATH", nim.Nim)
+		return ""
+	}
+	output, err := nim.Version()
+	if err != nil {
+		d.problem("", "%s --version failed (%s) %s", nimPath, err, output)
+		return ""
+	}
+	version, err := nim.ParseVersion(output)
+	if err != nil {
+		d.problem("", "%s (%s): %s", err, nimPath, strings.TrimSpace(output))
+		return ""
+	}
+	d.ok("Nim %s (%s)", version, nimPath)
+	return version
+}
+
+// checkDenimDir - ~/.denim and its subdirectories are writable and there's
+// enough free space for toolchains and builds
+func (d *doctor) checkDenimDir() {
+	rootDir := assets.GetRootDir()
+	dirs := []string{rootDir, assets.GetNimCacheRoot(), assets.GetCacheDir(), assets.GetNimLibDir(), assets.GetToolchainsDir()}
+	writable := true
+	for _, dir := range dirs {
+		testFile, err := ioutil.TempFile(dir, ".doctor-")
+		if err != nil {
+			writable = false
+			d.problem("Check the owner and permissions of the directory", "Cannot write to %s (%s)", dir, err)
+			continue
+		}
+		testFile.Close()
+		os.Remove(testFile.Name())
+	}
+	if writable {
+		d.ok("%s is writable", rootDir)
+	}
+
+	free, err := util.FreeDiskSpace(rootDir)
+	if err != nil {
+		d.problem("", "Could not determine free space of %s (%s)", rootDir, err)
+		return
+	}
+	if free < minFreeSpace {
+		d.problem("Toolchains need ~1GB, delete unused toolchains or ~/.denim/cache to free space", "Only %s free for %s", formatBytes(free), rootDir)
+		return
+	}
+	d.ok("%s free for %s", formatBytes(free), rootDir)
+}
+
+// checkClang - The toolchain exists, runs, and has obfuscation passes
+func (d *doctor) checkClang(clangDir string) (*ollvm.Clang, string) {
+	clang, err := ollvm.InitClang(clangDir)
+	if err != nil {
+		d.problem("Run 'denim setup' or 'denim toolchain install', or set $"+assets.ClangDirEnvVar, "No clang found in %s", clangDir)
+		return nil, ""
+	}
+	output, err := clang.Version()
+	if err != nil {
+		d.problem("The toolchain may be incomplete or built for another OS, try reinstalling it", "%s --version failed (%s) %s", clang.ClangExe, err, output)
+		return nil, ""
+	}
+	version := ""
+	if match := clangVersionRegex.FindStringSubmatch(output); match != nil {
+		version = match[1]
+	}
+	capabilities, err := clang.Probe()
+	if err != nil {
+		d.problem("", "%s", err)
+		return nil, version
+	}
+	d.ok("Toolchain %s, clang %s (%s)", capabilities.Flavor, version, clangDir)
+
+	passes := []string{}
+	for _, option := range []string{ollvm.OptBCF, ollvm.OptSub, ollvm.OptFlatten, ollvm.OptStringEncryption, ollvm.OptConstantEncryption} {
+		if clang.Supports(option) {
+			passes = append(passes, option)
+		}
+	}
+	if len(passes) == 0 {
+		d.problem("Use an obfuscator-llvm build, 'denim setup' installs one", "%s has no obfuscation passes", clang.ClangExe)
+	} else {
+		d.ok("Obfuscation passes: %s", strings.Join(passes, ", "))
+	}
+	if clang.HasTool("opt") && clang.HasTool("llvm-link") {
+		d.ok("opt and llvm-link found, --pipeline and --whole-program are available")
+		d.checkPipeline(clang)
+	} else {
+		d.ok("opt or llvm-link not found, --pipeline and --whole-program are unavailable")
+	}
+	return clang, version
+}
+
+// checkPipeline - The passes in the toolchain's opt actually obfuscate
+func (d *doctor) checkPipeline(clang *ollvm.Clang) {
+	pipeline := []*ollvm.Pass{}
+	for _, name := range ollvm.PipelinePasses {
+		if clang.SupportsPass(name) {
+			pipeline = append(pipeline, &ollvm.Pass{Name: name, Iterations: 1})
+		}
+	}
+	if len(pipeline) == 0 {
+		d.ok("opt has no obfuscation passes, --pipeline is unavailable")
+		return
+	}
+	err := clang.CheckPipeline(pipeline)
+	if err != nil {
+		d.problem("Build without --pipeline, or use a toolchain whose opt passes obfuscate", "%s", err)
+		return
+	}
+	d.ok("Pipeline passes change the code: %s", ollvm.PipelineString(pipeline))
+}
+
+// checkMingw - Windows builds need mingw-w64 headers and libs, from denim's
+// install on Windows or a sysroot when cross-compiling
+func (d *doctor) checkMingw() {
+	mingwDir := ""
+	if runtime.GOOS == "windows" {
+		var err error
+		mingwDir, err = assets.GetMingwDir()
+		if err != nil {
+			d.problem("Install the toolchain or pin an installed one, see 'denim toolchain list'", "%s", err)
+			return
+		}
+	} else {
+		target, err := build.GetTarget("windows/amd64", "")
+		if err != nil || target.Sysroot == "" {
+			d.ok("No mingw-w64 sysroot found, cross-compiling to windows is unavailable")
+			return
+		}
+		mingwDir = target.Sysroot
+	}
+	missing := []string{}
+	for _, file := range []string{filepath.Join("include", "windows.h"), filepath.Join("lib", "libkernel32.a")} {
+		found := false
+		for _, dir := range []string{mingwDir, filepath.Join(mingwDir, "x86_64-w64-mingw32")} {
+			if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, file)
+		}
+	}
+	if 0 < len(missing) {
+		d.problem("Re-run 'denim setup' or reinstall mingw-w64", "mingw-w64 in %s is missing %s", mingwDir, strings.Join(missing, ", "))
+		return
+	}
+	d.ok("mingw-w64 headers and libs found (%s)", mingwDir)
+}
+
+// checkCompile - Compile, link, and run a trivial obfuscated program with
+// every pass the toolchain has
+func (d *doctor) checkCompile(clang *ollvm.Clang) {
+	workDir, err := ioutil.TempDir("", "denim-doctor")
+	if err != nil {
+		d.problem("", "%s", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+	err = ioutil.WriteFile(filepath.Join(workDir, "doctor.c"), []byte(doctorProgram), 0600)
+	if err != nil {
+		d.problem("", "%s", err)
+		return
+	}
+	obfArgs := &ollvm.ObfArgs{
+		BCF: clang.Supports(ollvm.OptBCF), BCFProb: 100, BCFLoop: 1,
+		Sub: clang.Supports(ollvm.OptSub), SubLoop: 1,
+		Flatten: clang.Supports(ollvm.OptFlatten), FlattenSplit: 1,
+		AESSeed: ollvm.RandomSeed(),
+	}
+	_, stderr, err := clang.ObfCompile(workDir, []string{"-c", "doctor.c", "-o", "doctor.o"}, obfArgs)
+	if err != nil {
+		d.problem("", "Failed to compile an obfuscated program (%s)\n%s", err, stderr)
+		return
+	}
+
+	exe := filepath.Join(workDir, "doctor")
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	linker := []string{"doctor.o", "-o", exe}
+	if target, err := build.GetTarget("", ""); err == nil {
+		linker = append(linker, target.LinkFlags...)
+	}
+	_, stderr, err = clang.Compile(workDir, linker)
+	if err != nil {
+		hint := "Check that the system linker and C libraries are installed"
+		if runtime.GOOS == "windows" {
+			hint = "Check the mingw-w64 install"
+		}
+		d.problem(hint, "Failed to link an obfuscated program (%s)\n%s", err, stderr)
+		return
+	}
+	err = exec.Command(exe).Run()
+	if err != nil {
+		d.problem("The obfuscator miscompiled a trivial program, try another toolchain", "Obfuscated program failed (%s)", err)
+		return
+	}
+	d.ok("Compiled, linked, and ran an obfuscated program")
+}
+
+// checkVersions - Flag known-bad versions of nim and the toolchain
+func (d *doctor) checkVersions(nimVersion string, clangVersion string) {
+	for _, bad := range knownBadVersions {
+		if bad.Matches(nimVersion, clangVersion) {
+			d.problem(bad.Hint, "Nim %s with clang %s: %s", nimVersion, clangVersion, bad.Reason)
+		}
+	}
+}
+
+// compareVersions - Compare dotted numeric versions like strings.Compare
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for index := 0; index < len(aParts) || index < len(bParts); index++ {
+		aNum, bNum := 0, 0
+		if index < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[index])
+		}
+		if index < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[index])
+		}
+		if aNum != bNum {
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatBytes(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for 1024 <= value && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
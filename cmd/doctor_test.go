@@ -0,0 +1,63 @@
+package cmd
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"testing"
+)
+
+func TestKnownBadVersions(t *testing.T) {
+	tests := []struct {
+		nim   string
+		clang string
+		bad   int
+	}{
+		{nim: "2.0.2", clang: "4.0.1", bad: 0},
+		{nim: "1.6.12", clang: "17.0.6", bad: 0},
+		{nim: "1.6.10", clang: "16.0.0", bad: 1},
+		{nim: "1.4.8", clang: "17.0.6", bad: 1},
+		{nim: "1.6.10", clang: "15.0.7", bad: 0},
+		{nim: "0.19.6", clang: "3.9.1", bad: 2},
+		{nim: "0.19.6", clang: "", bad: 1},
+		{nim: "", clang: "16.0.0", bad: 0},
+	}
+	for _, test := range tests {
+		bad := 0
+		for _, versions := range knownBadVersions {
+			if versions.Matches(test.nim, test.clang) {
+				bad++
+			}
+		}
+		if bad != test.bad {
+			t.Errorf("Nim %q with clang %q: %d known-bad matches, want %d", test.nim, test.clang, bad, test.bad)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{a: "1.6.12", b: "1.6.2", want: 1},
+		{a: "1.6", b: "1.6.0", want: 0},
+		{a: "4.0.1", b: "16.0.0", want: -1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package cmd
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moloch--/denim/pkg/logger"
+	"github.com/moloch--/denim/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Output formats
+	outputText = "text"
+	outputJSON = "json"
+
+	// levelSuccess - Event level of printWoot, the other event levels are
+	// the log level names
+	levelSuccess = "success"
+)
+
+var (
+	output = &commandOutput{Format: outputText, Data: map[string]interface{}{}}
+)
+
+// commandOutput - The messages and result of the running command, in JSON
+// mode each message is a JSON event on its own line followed by a result
+// object, and anything meant for humans goes to stderr
+type commandOutput struct {
+	Format  string
+	Command string
+	Start   time.Time
+
+	mutex    sync.Mutex
+	Errors   []string
+	Warnings []string
+	Data     map[string]interface{}
+}
+
+type outputEvent struct {
+	Type    string `json:"type"`
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+type outputResult struct {
+	Type     string                 `json:"type"`
+	Command  string                 `json:"command"`
+	Success  bool                   `json:"success"`
+	Errors   []string               `json:"errors"`
+	Warnings []string               `json:"warnings"`
+	Duration float64                `json:"duration"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+// initOutput - Select the output format, log level, and colors before a
+// command runs
+func initOutput(cmd *cobra.Command, args []string) error {
+	format, err := cmd.Flags().GetString(outputFormatFlagStr)
+	if err != nil {
+		return err
+	}
+	if format != outputText && format != outputJSON {
+		return fmt.Errorf("Invalid --%s '%s' (valid formats: %s, %s)", outputFormatFlagStr, format, outputText, outputJSON)
+	}
+	levelName, err := cmd.Flags().GetString(logLevelFlagStr)
+	if err != nil {
+		return err
+	}
+	level, err := logger.ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	noColor, err := cmd.Flags().GetBool(noColorFlagStr)
+	if err != nil {
+		return err
+	}
+	output.Format = format
+	output.Command = cmd.CommandPath()
+	output.Start = time.Now()
+	logger.SetLevel(level)
+	console := os.Stdout
+	if isJSON() {
+		console = os.Stderr
+		util.Progress = ioutil.Discard
+		logger.SetHandler(printJSONEvent)
+	}
+	logger.SetConsole(console)
+	logger.SetColor(!noColor && os.Getenv("NO_COLOR") == "" && logger.IsTerminal(console))
+	return nil
+}
+
+// finishOutput - Emit the result object once a command is done
+func finishOutput() {
+	if !isJSON() {
+		return
+	}
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	result := &outputResult{
+		Type:     "result",
+		Command:  output.Command,
+		Success:  len(output.Errors) == 0,
+		Errors:   append([]string{}, output.Errors...),
+		Warnings: append([]string{}, output.Warnings...),
+		Duration: time.Since(output.Start).Seconds(),
+		Data:     output.Data,
+	}
+	data, _ := json.Marshal(result)
+	fmt.Println(string(data))
+}
+
+func isJSON() bool {
+	return output.Format == outputJSON
+}
+
+// hasErrors - Has the command failed
+func hasErrors() bool {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	return 0 < len(output.Errors)
+}
+
+// setResult - Add a value to the command's result object
+func setResult(key string, value interface{}) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	output.Data[key] = value
+}
+
+func printDebug(format string, args ...interface{}) {
+	printEvent(logger.DebugLevel, false, format, args...)
+}
+
+func printInfo(format string, args ...interface{}) {
+	printEvent(logger.InfoLevel, false, format, args...)
+}
+
+func printWoot(format string, args ...interface{}) {
+	printEvent(logger.InfoLevel, true, format, args...)
+}
+
+// printWarn - Something the user should know about, the command continues
+func printWarn(format string, args ...interface{}) {
+	printEvent(logger.WarnLevel, false, format, args...)
+}
+
+// printError - The command failed
+func printError(format string, args ...interface{}) {
+	printEvent(logger.ErrorLevel, false, format, args...)
+}
+
+// printText - Human readable output that has no place in JSON output,
+// commands add the same information to their result with setResult
+func printText(format string, args ...interface{}) {
+	if isJSON() {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// printEvent - Log the message, in JSON mode it's an event instead of a
+// line on the console (it's still recorded in the build log)
+func printEvent(level logger.Level, success bool, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if !isJSON() {
+		addMessage(level, message)
+	}
+	logger.Log(level, success, "%s", message) // Calls printJSONEvent in JSON mode
+}
+
+// addMessage - Add errors and warnings to the result
+func addMessage(level logger.Level, message string) {
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	switch level {
+	case logger.ErrorLevel:
+		output.Errors = append(output.Errors, strings.TrimSpace(message))
+	case logger.WarnLevel:
+		output.Warnings = append(output.Warnings, strings.TrimSpace(message))
+	}
+}
+
+// printJSONEvent - The logger's handler in JSON mode, so messages logged
+// by the build (not just the commands) are events too
+func printJSONEvent(level logger.Level, success bool, message string) {
+	addMessage(level, message)
+	if !logger.Enabled(level) {
+		return
+	}
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	eventLevel := level.String()
+	if success {
+		eventLevel = levelSuccess
+	}
+	data, _ := json.Marshal(&outputEvent{
+		Type:    "event",
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   eventLevel,
+		Message: strings.TrimSpace(message),
+	})
+	fmt.Println(string(data))
+}
@@ -17,17 +17,20 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/moloch--/denim/pkg/assets"
 	"github.com/moloch--/denim/pkg/nim"
+	"github.com/moloch--/denim/pkg/ollvm"
 	"github.com/moloch--/denim/pkg/util"
 	"github.com/spf13/cobra"
 )
@@ -36,9 +39,15 @@ var (
 	// ObfuscatorLLVMURL - URL to a O-LLVM Github repo
 	ObfuscatorLLVMURL string
 
+	// ObfuscatorLLVMVersion - Version of the O-LLVM build at ObfuscatorLLVMURL
+	ObfuscatorLLVMVersion = "9.0.1"
+
 	// Mingw64URL - URL to mingw-x64 download
 	Mingw64URL string
 
+	// Mingw64Version - Version of the mingw-x64 build at Mingw64URL
+	Mingw64Version = "8.1.0"
+
 	// SevenZipURL - The MinGW people are assholes and only distribute 7z files
 	SevenZipURL string
 )
@@ -53,11 +62,23 @@ var setupCmd = &cobra.Command{
 }
 
 func setup(cmd *cobra.Command, args []string) {
-	denimDir := assets.GetRootDir()
-
 	_, err := nim.Version()
 	if err != nil {
-		fmt.Printf(Warn + "Nim does not appear to be on your PATH!\n")
+		printWarn("Nim does not appear to be on your PATH!\n")
+	}
+
+	ollvmURL, err := cmd.Flags().GetString(ollvmURLFlagStr)
+	if err != nil {
+		printError("Failed to parse --%s flag: %s\n", ollvmURLFlagStr, err)
+		return
+	}
+	if ollvmURL == "" {
+		ollvmURL = ObfuscatorLLVMURL
+	}
+	if ollvmURL == "" {
+		printError("This build of denim has no default obfuscator-llvm download for %s, run 'denim setup --%s <url>' with the URL of a %s obfuscator-llvm build (.tar.gz), or build denim with 'make OLLVM_URL=<url>'\n",
+			runtime.GOOS, ollvmURLFlagStr, runtime.GOOS)
+		return
 	}
 
 	client := initHTTPClient(cmd)
@@ -65,88 +86,191 @@ func setup(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	// 7z
-	fmt.Println(Info + "Downloading 7-zip ...")
-	sevenZip := filepath.Join(denimDir, "7z.zip")
-	if _, err := os.Stat(sevenZip); !os.IsNotExist(err) {
-		os.Remove(sevenZip)
+	installed := []map[string]interface{}{}
+	defer func() { setResult("toolchains", installed) }()
+
+	// Linux hosts use the system's linker and libc, only Windows needs mingw
+	if runtime.GOOS == "windows" {
+		toolchain, err := setupToolchain(client, assets.MingwToolchain, Mingw64Version, Mingw64URL)
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		installed = append(installed, toolchainResult(toolchain, true))
 	}
-	err = downloadAsset(client, SevenZipURL, sevenZip)
+
+	toolchain, err := setupToolchain(client, assets.OLLVMToolchain, ObfuscatorLLVMVersion, ollvmURL)
 	if err != nil {
-		fmt.Printf(Warn+"Download failed %s\n", err)
+		printError("%s\n", err)
 		return
 	}
-	fmt.Println(Info + "Extracting 7z ...")
+	installed = append(installed, toolchainResult(toolchain, true))
+}
+
+// setupToolchain - Install a toolchain and make it the active one
+func setupToolchain(client *http.Client, kind string, version string, assetURL string) (*assets.Toolchain, error) {
+	toolchain, err := installToolchain(client, kind, version, assetURL)
+	if err != nil {
+		return nil, err
+	}
+	return toolchain, assets.UseToolchain(toolchain)
+}
+
+// installToolchain - Download and extract a toolchain into the toolchains dir
+func installToolchain(client *http.Client, kind string, version string, assetURL string) (*assets.Toolchain, error) {
+	toolchain := &assets.Toolchain{
+		Kind:    kind,
+		Version: version,
+		URL:     assetURL,
+	}
+	err := toolchain.Validate()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := assets.LockToolchain(toolchain.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	installDir := toolchain.Dir()
+	if _, err := os.Stat(installDir); !os.IsNotExist(err) {
+		err = assets.RemoveToolchainDir(toolchain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rootMarker string
+	switch kind {
+	case assets.MingwToolchain:
+		err = installMingw(client, assetURL, installDir)
+		rootMarker = "bin"
+	case assets.OLLVMToolchain:
+		err = installObfuscatorLLVM(client, assetURL, installDir)
+		rootMarker = filepath.Join("bin", ollvm.ClangExeName)
+	default:
+		err = fmt.Errorf("Unknown toolchain kind '%s'", kind)
+	}
+	if err != nil {
+		assets.RemoveToolchainDir(toolchain)
+		return nil, err
+	}
+
+	root, err := findToolchainRoot(installDir, rootMarker)
+	if err != nil {
+		assets.RemoveToolchainDir(toolchain)
+		return nil, err
+	}
+	toolchain.Root = root
+	err = assets.SaveToolchain(toolchain)
+	if err != nil {
+		return nil, err
+	}
+	return toolchain, nil
+}
+
+// findToolchainRoot - Archives may or may not have a top level directory
+func findToolchainRoot(installDir string, marker string) (string, error) {
+	if _, err := os.Stat(filepath.Join(installDir, marker)); err == nil {
+		return "", nil
+	}
+	entries, err := ioutil.ReadDir(installDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(installDir, entry.Name(), marker)); err == nil {
+			return entry.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("Could not find %s in toolchain archive", marker)
+}
+
+func install7z(client *http.Client, denimDir string) (string, error) {
 	sevenZipDir := filepath.Join(denimDir, "7z")
-	util.Unzip(sevenZip, sevenZipDir)
 	sevenZipExe := filepath.Join(sevenZipDir, "7za.exe")
-	os.Remove(sevenZip)
-
-	// Mingw-x64
-	fmt.Println(Info + "Downloading mingw-x64 ...")
-	mingw7z := filepath.Join(denimDir, "mingw-x64.7z")
-	if _, err := os.Stat(mingw7z); !os.IsNotExist(err) {
-		os.Remove(mingw7z)
+	if _, err := os.Stat(sevenZipExe); err == nil {
+		return sevenZipExe, nil
 	}
-	err = downloadAsset(client, Mingw64URL, mingw7z)
+	lock, err := assets.LockToolchain("7z")
 	if err != nil {
-		fmt.Printf(Warn+"Download failed %s\n", err)
-		return
+		return "", err
 	}
-	fmt.Println(Info + "Extracting mingw-x64 ...")
-	err = util.Extract7z(sevenZipExe, mingw7z, denimDir)
+	defer lock.Unlock()
+	if _, err := os.Stat(sevenZipExe); err == nil {
+		return sevenZipExe, nil // Installed while we waited for the lock
+	}
+	printInfo("Downloading 7-zip ...\n")
+	sevenZip, err := downloadTempAsset(client, SevenZipURL, denimDir, "7z-*.zip")
 	if err != nil {
-		fmt.Printf(Warn+"Failed to extract mingw-x64 %s\n", err)
-		return
+		return "", err
 	}
-	os.Remove(mingw7z)
+	defer os.Remove(sevenZip)
+	printInfo("Extracting 7z ...\n")
+	util.Unzip(sevenZip, sevenZipDir)
+	return sevenZipExe, nil
+}
 
-	// obfuscator-llvm
-	fmt.Println(Info + "Downloading obfuscator-llvm ...")
-	llvmTar := filepath.Join(denimDir, "ollvm.tar.gz")
-	if _, err := os.Stat(llvmTar); !os.IsNotExist(err) {
-		os.Remove(llvmTar)
+func installMingw(client *http.Client, mingwURL string, installDir string) error {
+	denimDir := assets.GetRootDir()
+	sevenZipExe, err := install7z(client, denimDir)
+	if err != nil {
+		return err
 	}
-	err = downloadAsset(client, ObfuscatorLLVMURL, llvmTar)
+
+	printInfo("Downloading mingw-x64 ...\n")
+	mingw7z, err := downloadTempAsset(client, mingwURL, installDir, ".mingw-x64-*.7z")
 	if err != nil {
-		fmt.Printf(Warn+"Download failed %s\n", err)
-		return
+		return err
 	}
-	fmt.Println(Info + "Extracting obfuscator-llvm ...")
-	unpackDir := filepath.Join(denimDir, "ollvm")
-	if _, err := os.Stat(unpackDir); !os.IsNotExist(err) {
-		os.RemoveAll(unpackDir)
+	defer os.Remove(mingw7z)
+	printInfo("Extracting mingw-x64 ...\n")
+	err = util.Extract7z(sevenZipExe, mingw7z, installDir)
+	if err != nil {
+		return fmt.Errorf("Failed to extract mingw-x64 %s", err)
 	}
-	tarReader, err := os.Open(llvmTar)
+	return nil
+}
+
+func installObfuscatorLLVM(client *http.Client, ollvmURL string, installDir string) error {
+	printInfo("Downloading obfuscator-llvm ...\n")
+	llvmTar, err := downloadTempAsset(client, ollvmURL, installDir, ".ollvm-*.tar.gz")
 	if err != nil {
-		fmt.Printf(Warn+"Failed to read %s", err)
-		return
+		return err
 	}
-	err = util.Untar(unpackDir, tarReader)
+	defer os.Remove(llvmTar)
+	printInfo("Extracting obfuscator-llvm ...\n")
+	tarReader, err := os.Open(llvmTar)
 	if err != nil {
-		fmt.Printf(Warn+"Failed to extract obfuscator-llvm %s", err)
-		return
+		return fmt.Errorf("Failed to read %s", err)
 	}
+	err = util.Untar(installDir, tarReader)
 	tarReader.Close()
-	os.Remove(llvmTar)
+	if err != nil {
+		return fmt.Errorf("Failed to extract obfuscator-llvm %s", err)
+	}
+	return nil
 }
 
 func initHTTPClient(cmd *cobra.Command) *http.Client {
 	timeoutSeconds, err := cmd.Flags().GetInt(timeoutFlagStr)
 	timeout := time.Duration(timeoutSeconds * int(time.Second))
 	if err != nil {
-		fmt.Printf("Failed to parse --%s flag: %s\n", timeoutFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", timeoutFlagStr, err)
 		return nil
 	}
 
 	skipTLSValidation, err := cmd.Flags().GetBool(skipTLSValidationFlagStr)
 	if err != nil {
-		fmt.Printf("Failed to parse --%s flag: %s\n", skipTLSValidationFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", skipTLSValidationFlagStr, err)
 		return nil
 	}
 	if skipTLSValidation {
-		fmt.Println()
-		fmt.Println(Warn + "You're trying to download the compilers over an insecure connection, this is a bad idea!")
+		printText("\n")
+		printWarn("You're trying to download the compilers over an insecure connection, this is a bad idea!\n")
 		confirm := false
 		prompt := &survey.Confirm{Message: "Continue?"}
 		survey.AskOne(prompt, &confirm)
@@ -163,14 +287,14 @@ func initHTTPClient(cmd *cobra.Command) *http.Client {
 
 	proxy, err := cmd.Flags().GetString(proxyFlagStr)
 	if err != nil {
-		fmt.Printf("Failed to parse --%s flag: %s\n", proxyFlagStr, err)
+		printError("Failed to parse --%s flag: %s\n", proxyFlagStr, err)
 		return nil
 	}
 	var proxyURL *url.URL = nil
 	if proxy != "" {
 		proxyURL, err = url.Parse(proxy)
 		if err != nil {
-			fmt.Printf(Warn+"%s", err)
+			printError("%s", err)
 			return nil
 		}
 	}
@@ -192,6 +316,26 @@ func initHTTPClient(cmd *cobra.Command) *http.Client {
 	return client
 }
 
+// downloadTempAsset - Download to a new temp file in dir, so concurrent
+// installs never share an archive. The caller removes the file.
+func downloadTempAsset(client *http.Client, assetURL string, dir string, pattern string) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	tmpFile.Close()
+	err = downloadAsset(client, assetURL, tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("Download failed %s", err)
+	}
+	return tmpFile.Name(), nil
+}
+
 func downloadAsset(client *http.Client, assetURL string, saveTo string) error {
 	writer, err := os.Create(saveTo)
 	if err != nil {
@@ -206,7 +350,7 @@ func downloadAsset(client *http.Client, assetURL string, saveTo string) error {
 	io.Copy(writer, barReader)
 	writer.Close()
 	bar.Finish()
-	fmt.Printf(upN, 1)
-	fmt.Printf(clearln + "\r")
+	printText(upN, 1)
+	printText(clearln + "\r")
 	return nil
 }
@@ -0,0 +1,209 @@
+package cmd
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"os"
+
+	"github.com/moloch--/denim/pkg/assets"
+	"github.com/moloch--/denim/pkg/ollvm"
+	"github.com/spf13/cobra"
+)
+
+var toolchainCmd = &cobra.Command{
+	Use:   "toolchain",
+	Short: "Manage toolchains",
+	Long:  `Install and switch between obfuscator-llvm and mingw-x64 versions`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var toolchainListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List installed toolchains",
+	Long:  `List installed toolchains, * marks the active toolchains`,
+	Run: func(cmd *cobra.Command, args []string) {
+		toolchains, err := assets.ListToolchains()
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		results := []map[string]interface{}{}
+		defer func() { setResult("toolchains", results) }()
+		if len(toolchains) == 0 {
+			printInfo("No toolchains installed, run 'denim setup' or 'denim toolchain install'\n")
+			return
+		}
+		for _, toolchain := range toolchains {
+			marker := " "
+			if resolved, err := assets.ResolveToolchain(toolchain.Kind); err == nil && resolved != nil && resolved.Name() == toolchain.Name() {
+				marker = "*"
+			}
+			printText("%s %s\n", marker, toolchain.Name())
+			results = append(results, toolchainResult(toolchain, marker == "*"))
+		}
+	},
+}
+
+var toolchainInstallCmd = &cobra.Command{
+	Use:   "install <kind> <version>",
+	Short: "Install a toolchain",
+	Long:  `Install a toolchain, kind is one of: ollvm, mingw64`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		kind, version := args[0], args[1]
+		err := (&assets.Toolchain{Kind: kind, Version: version}).Validate()
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		assetURL, err := cmd.Flags().GetString(urlFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", urlFlagStr, err)
+			return
+		}
+		if assetURL == "" {
+			switch {
+			case kind == assets.OLLVMToolchain && version == ObfuscatorLLVMVersion:
+				assetURL = ObfuscatorLLVMURL
+			case kind == assets.MingwToolchain && version == Mingw64Version:
+				assetURL = Mingw64URL
+			}
+		}
+		if assetURL == "" {
+			printError("No known download for %s-%s, specify one with --%s\n", kind, version, urlFlagStr)
+			return
+		}
+		client := initHTTPClient(cmd)
+		if client == nil {
+			return
+		}
+		toolchain, err := installToolchain(client, kind, version, assetURL)
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		printInfo("Installed %s\n", toolchain.Name())
+		setResult("toolchain", toolchainResult(toolchain, false))
+		active, err := assets.ActiveToolchains()
+		if err == nil && active[kind] == "" {
+			err = assets.UseToolchain(toolchain)
+			if err != nil {
+				printError("%s\n", err)
+				return
+			}
+			printInfo("Using %s\n", toolchain.Name())
+		}
+	},
+}
+
+var toolchainUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "Set the active toolchain",
+	Long:  `Set the active toolchain, or pin it for the project in the current directory`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		toolchain, err := assets.GetToolchain(args[0])
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		project, err := cmd.Flags().GetBool(projectFlagStr)
+		if err != nil {
+			printError("Failed to parse --%s flag: %s\n", projectFlagStr, err)
+			return
+		}
+		if project {
+			cwd, err := os.Getwd()
+			if err != nil {
+				printError("%s\n", err)
+				return
+			}
+			err = assets.UseProjectToolchain(cwd, toolchain)
+			if err != nil {
+				printError("%s\n", err)
+				return
+			}
+			printInfo("Pinned %s in %s\n", toolchain.Name(), assets.ProjectToolchainFile)
+			return
+		}
+		err = assets.UseToolchain(toolchain)
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		printInfo("Using %s\n", toolchain.Name())
+	},
+}
+
+var toolchainRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a toolchain",
+	Long:  `Remove an installed toolchain`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		toolchain, err := assets.GetToolchain(args[0])
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		err = assets.RemoveToolchain(toolchain)
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		printInfo("Removed %s\n", toolchain.Name())
+	},
+}
+
+var toolchainInfoCmd = &cobra.Command{
+	Use:   "info <name>",
+	Short: "Display toolchain information",
+	Long:  `Display information about an installed toolchain`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		toolchain, err := assets.GetToolchain(args[0])
+		if err != nil {
+			printError("%s\n", err)
+			return
+		}
+		setResult("toolchain", toolchainResult(toolchain, false))
+		printText("Name:    %s\n", toolchain.Name())
+		printText("Version: %s\n", toolchain.Version)
+		printText("Path:    %s\n", toolchain.RootDir())
+		printText("URL:     %s\n", toolchain.URL)
+		if toolchain.Kind != assets.OLLVMToolchain {
+			return
+		}
+		clang, err := ollvm.InitClang(toolchain.RootDir())
+		if err != nil {
+			printError("Toolchain is broken %s\n", err)
+			return
+		}
+		printCapabilities(clang)
+	},
+}
+
+// toolchainResult - A toolchain in JSON output
+func toolchainResult(toolchain *assets.Toolchain, active bool) map[string]interface{} {
+	return map[string]interface{}{
+		"name":    toolchain.Name(),
+		"kind":    toolchain.Kind,
+		"version": toolchain.Version,
+		"url":     toolchain.URL,
+		"path":    toolchain.RootDir(),
+		"active":  active,
+	}
+}
@@ -14,9 +14,8 @@ package cmd
 */
 
 import (
-	"fmt"
+	"strings"
 
-	"github.com/moloch--/denim/pkg/assets"
 	"github.com/moloch--/denim/pkg/nim"
 	"github.com/moloch--/denim/pkg/ollvm"
 	"github.com/spf13/cobra"
@@ -32,26 +31,59 @@ var versionCmd = &cobra.Command{
 	Short: "Display version information",
 	Long:  `Print the version number of denim and exit`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("Denim v%s\n\n", Version)
+		printText("Denim v%s\n\n", Version)
+		setResult("denim", Version)
 
 		nimVer, err := nim.Version()
 		if err != nil {
-			fmt.Printf(Warn + "Nim does not appear to be on your PATH!\n")
+			printWarn("Nim does not appear to be on your PATH!\n")
 		} else {
-			fmt.Printf(nimVer + "\n\n")
+			printText("%s\n\n", nimVer)
+			setResult("nim", strings.TrimSpace(nimVer))
 		}
 
-		clang, err := ollvm.InitClang(assets.GetClangDir())
+		clangDir, err := getClangDir(cmd)
 		if err != nil {
-			fmt.Printf(Warn + "No clang, please run 'denim setup'")
+			return
+		}
+		clang, err := ollvm.InitClang(clangDir)
+		if err != nil {
+			printWarn("No clang, please run 'denim setup'\n")
 		} else {
 			clangVer, err := clang.Version()
 			if err != nil {
-				fmt.Printf(Warn+"%s\n", err)
+				printError("%s\n", err)
 			} else {
-				fmt.Printf(clangVer + "\n")
+				printText("%s\n", clangVer)
+				setResult("clang", strings.TrimSpace(clangVer))
 			}
+			printCapabilities(clang)
 		}
 
 	},
 }
+
+func printCapabilities(clang *ollvm.Clang) {
+	capabilities, err := clang.Probe()
+	if err != nil {
+		printError("%s\n", err)
+		return
+	}
+	setResult("capabilities", capabilities)
+	printText("Toolchain: %s\n", capabilities.Flavor)
+	for _, option := range ollvm.Options() {
+		if name, ok := capabilities.Options[option]; ok {
+			printText("  %s (-%s)\n", option, name)
+		} else {
+			printText("  %s (unsupported)\n", option)
+		}
+	}
+	printText("Pipeline passes (opt):\n")
+	for _, pass := range ollvm.PipelinePasses {
+		if capabilities.Passes[pass] {
+			printText("  %s\n", pass)
+		} else {
+			printText("  %s (unsupported)\n", pass)
+		}
+	}
+}
@@ -4,6 +4,8 @@ go 1.16
 
 require (
 	github.com/AlecAivazis/survey/v2 v2.2.7
+	github.com/BurntSushi/toml v1.2.1
 	github.com/cheggaaa/pb/v3 v3.0.5
 	github.com/spf13/cobra v1.1.1
+	golang.org/x/sys v0.0.0-20200116001909-b77594299b42
 )
@@ -14,22 +14,32 @@ package assets
 */
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/user"
-	"path"
 	"path/filepath"
+	"sync"
+
+	"github.com/moloch--/denim/pkg/logger"
 )
 
 const (
 	// DenimRootDirName - Directory storing all of the client configs/logs
 	DenimRootDirName = ".denim"
+
+	// ClangDirEnvVar - Use an existing obfuscator toolchain instead of ours
+	ClangDirEnvVar = "DENIM_CLANG_DIR"
+)
+
+var (
+	clangDirEnvWarning sync.Once
 )
 
 // GetRootDir - Get the denim root directory
 func GetRootDir() string {
 	user, _ := user.Current()
-	dir := path.Join(user.HomeDir, DenimRootDirName)
+	dir := filepath.Join(user.HomeDir, DenimRootDirName)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		err = os.MkdirAll(dir, 0700)
 		if err != nil {
@@ -39,10 +49,29 @@ func GetRootDir() string {
 	return dir
 }
 
-// GetClangDir - Get the clang root directory
-func GetClangDir() string {
+// GetClangDir - Get the clang root directory, a toolchain pinned with
+// PinToolchains() takes precedence over $DENIM_CLANG_DIR, which takes
+// precedence over the project's pin
+func GetClangDir() (string, error) {
+	if clangDir := os.Getenv(ClangDirEnvVar); clangDir != "" && !IsPinned(OLLVMToolchain) {
+		if name := projectPin(OLLVMToolchain); name != "" {
+			clangDirEnvWarning.Do(func() {
+				logger.Warnf("$%s (%s) overrides the %s pinned in %s\n", ClangDirEnvVar, clangDir, name, ProjectToolchainFile)
+			})
+		}
+		return clangDir, nil
+	}
+	toolchain, err := ResolveToolchain(OLLVMToolchain)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve %s toolchain: %s", OLLVMToolchain, err)
+	}
+	if toolchain != nil {
+		return toolchain.RootDir(), nil
+	}
+
+	// Pre-toolchain manager install
 	rootDir := GetRootDir()
-	return filepath.Join(rootDir, "ollvm", "build")
+	return filepath.Join(rootDir, "ollvm", "build"), nil
 }
 
 // GetNimCacheRoot - Get the clang root directory
@@ -58,15 +87,63 @@ func GetNimCacheRoot() string {
 	return nimcache
 }
 
-// GetMingwDir - Get mingw64 root dir
-func GetMingwDir() string {
+// GetCacheDir - Get the object cache directory
+func GetCacheDir() string {
 	rootDir := GetRootDir()
-	nimcache := filepath.Join(rootDir, "mingw64")
-	if _, err := os.Stat(nimcache); os.IsNotExist(err) {
-		err = os.MkdirAll(nimcache, 0700)
+	cache := filepath.Join(rootDir, "cache")
+	if _, err := os.Stat(cache); os.IsNotExist(err) {
+		err = os.MkdirAll(cache, 0700)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	return nimcache
+	return cache
+}
+
+// GetLogsDir - Get the build logs directory
+func GetLogsDir() string {
+	rootDir := GetRootDir()
+	logs := filepath.Join(rootDir, "logs")
+	if _, err := os.Stat(logs); os.IsNotExist(err) {
+		err = os.MkdirAll(logs, 0700)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return logs
+}
+
+// GetNimLibDir - Get the directory of nim modules shipped with denim
+func GetNimLibDir() string {
+	rootDir := GetRootDir()
+	nimLib := filepath.Join(rootDir, "nim")
+	if _, err := os.Stat(nimLib); os.IsNotExist(err) {
+		err = os.MkdirAll(nimLib, 0700)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return nimLib
+}
+
+// GetMingwDir - Get mingw64 root dir
+func GetMingwDir() (string, error) {
+	toolchain, err := ResolveToolchain(MingwToolchain)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve %s toolchain: %s", MingwToolchain, err)
+	}
+	if toolchain != nil {
+		return toolchain.RootDir(), nil
+	}
+
+	// Pre-toolchain manager install
+	rootDir := GetRootDir()
+	mingwDir := filepath.Join(rootDir, "mingw64")
+	if _, err := os.Stat(mingwDir); os.IsNotExist(err) {
+		err = os.MkdirAll(mingwDir, 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+	return mingwDir, nil
 }
@@ -0,0 +1,70 @@
+package assets
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// FileLock - An exclusive lock on a file, shared between denim processes
+type FileLock struct {
+	file *os.File
+}
+
+// GetLocksDir - Get the directory of lock files
+func GetLocksDir() string {
+	rootDir := GetRootDir()
+	locks := filepath.Join(rootDir, "locks")
+	if _, err := os.Stat(locks); os.IsNotExist(err) {
+		err = os.MkdirAll(locks, 0700)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return locks
+}
+
+// Lock - Wait for an exclusive lock on a name (e.g. "toolchains")
+func Lock(name string) (*FileLock, error) {
+	lock, _, err := lockPath(filepath.Join(GetLocksDir(), name+".lock"), true)
+	return lock, err
+}
+
+// TryLock - Lock a path without waiting, returns false if another
+// process holds the lock
+func TryLock(path string) (*FileLock, bool, error) {
+	return lockPath(path, false)
+}
+
+// Unlock - Release the lock
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.file)
+	l.file.Close()
+	return err
+}
+
+func lockPath(path string, wait bool) (*FileLock, bool, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	locked, err := lockFile(file, wait)
+	if err != nil || !locked {
+		file.Close()
+		return nil, false, err
+	}
+	return &FileLock{file: file}, true, nil
+}
@@ -0,0 +1,384 @@
+package assets
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// OLLVMToolchain - Obfuscator-LLVM (or a fork) toolchain kind
+	OLLVMToolchain = "ollvm"
+	// MingwToolchain - Mingw-w64 toolchain kind
+	MingwToolchain = "mingw64"
+
+	// ProjectToolchainFile - Pins toolchains for a project, one name per line
+	ProjectToolchainFile = ".denim-toolchain"
+
+	toolchainsDirName    = "toolchains"
+	toolchainMetaName    = "toolchain.json"
+	activeToolchainsName = "active.json"
+	activeToolchainsLock = "active-toolchains"
+)
+
+var (
+	// ToolchainKinds - Kinds of toolchains denim manages
+	ToolchainKinds = []string{OLLVMToolchain, MingwToolchain}
+
+	// pinned - Toolchains pinned for this process (e.g. compile --toolchain)
+	pinned = map[string]string{}
+
+	versionRegex = regexp.MustCompile(`^[A-Za-z0-9._+-]+$`)
+)
+
+// Toolchain - An installed toolchain
+type Toolchain struct {
+	Kind    string `json:"kind"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+
+	// Root - Sub directory of the install containing bin/
+	Root string `json:"root"`
+}
+
+// Name - The <kind>-<version> name of the toolchain
+func (t *Toolchain) Name() string {
+	return fmt.Sprintf("%s-%s", t.Kind, t.Version)
+}
+
+// Dir - The install directory of the toolchain
+func (t *Toolchain) Dir() string {
+	return filepath.Join(GetToolchainsDir(), t.Name())
+}
+
+// RootDir - The directory containing the toolchain's bin/
+func (t *Toolchain) RootDir() string {
+	return filepath.Join(t.Dir(), t.Root)
+}
+
+// Validate - The kind and version end up in the install directory, which is
+// deleted when a toolchain is (re)installed or removed, so they must not be
+// able to point it anywhere else
+func (t *Toolchain) Validate() error {
+	if !isToolchainKind(t.Kind) {
+		return fmt.Errorf("Unknown toolchain kind '%s' (valid kinds: %s)", t.Kind, strings.Join(ToolchainKinds, ", "))
+	}
+	err := ValidateToolchainVersion(t.Version)
+	if err != nil {
+		return err
+	}
+	toolchainsDir := GetToolchainsDir()
+	rel, err := filepath.Rel(toolchainsDir, filepath.Clean(t.Dir()))
+	if err != nil || rel != t.Name() {
+		return fmt.Errorf("Toolchain directory %s is not in %s", t.Dir(), toolchainsDir)
+	}
+	return nil
+}
+
+// ValidateToolchainVersion - Versions are directory names, they may only
+// contain letters, numbers, and . _ + -
+func ValidateToolchainVersion(version string) error {
+	if !versionRegex.MatchString(version) || strings.Contains(version, "..") {
+		return fmt.Errorf("Invalid toolchain version '%s', versions may only contain letters, numbers, and . _ + -", version)
+	}
+	return nil
+}
+
+func isToolchainKind(kind string) bool {
+	for _, toolchainKind := range ToolchainKinds {
+		if kind == toolchainKind {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseToolchainName - Split a <kind>-<version> name
+func ParseToolchainName(name string) (string, string, error) {
+	for _, kind := range ToolchainKinds {
+		if strings.HasPrefix(name, kind+"-") && len(kind)+1 < len(name) {
+			version := name[len(kind)+1:]
+			if err := ValidateToolchainVersion(version); err != nil {
+				return "", "", err
+			}
+			return kind, version, nil
+		}
+	}
+	return "", "", fmt.Errorf("Invalid toolchain name '%s', expected <%s>-<version>", name, strings.Join(ToolchainKinds, "|"))
+}
+
+// GetToolchainsDir - Get the directory toolchains are installed in
+func GetToolchainsDir() string {
+	rootDir := GetRootDir()
+	dir := filepath.Join(rootDir, toolchainsDirName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// GetToolchain - Get an installed toolchain by name
+func GetToolchain(name string) (*Toolchain, error) {
+	_, _, err := ParseToolchainName(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(GetToolchainsDir(), name, toolchainMetaName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Toolchain '%s' is not installed", name)
+		}
+		return nil, err
+	}
+	toolchain := &Toolchain{}
+	err = json.Unmarshal(data, toolchain)
+	if err != nil {
+		return nil, err
+	}
+	if toolchain.Name() != name {
+		return nil, fmt.Errorf("Toolchain '%s' metadata is for '%s'", name, toolchain.Name())
+	}
+	return toolchain, toolchain.Validate()
+}
+
+// ListToolchains - List installed toolchains sorted by name
+func ListToolchains() ([]*Toolchain, error) {
+	entries, err := ioutil.ReadDir(GetToolchainsDir())
+	if err != nil {
+		return nil, err
+	}
+	toolchains := []*Toolchain{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		toolchain, err := GetToolchain(entry.Name())
+		if err != nil {
+			continue // Partial install or not ours
+		}
+		toolchains = append(toolchains, toolchain)
+	}
+	sort.Slice(toolchains, func(i, j int) bool {
+		return toolchains[i].Name() < toolchains[j].Name()
+	})
+	return toolchains, nil
+}
+
+// SaveToolchain - Record a toolchain as installed
+func SaveToolchain(toolchain *Toolchain) error {
+	data, err := json.MarshalIndent(toolchain, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(toolchain.Dir(), toolchainMetaName), data, 0600)
+}
+
+// RemoveToolchain - Delete a toolchain, and deactivate it if it's active
+func RemoveToolchain(toolchain *Toolchain) error {
+	lock, err := LockToolchain(toolchain.Name())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	activeLock, err := Lock(activeToolchainsLock)
+	if err != nil {
+		return err
+	}
+	defer activeLock.Unlock()
+	active, err := ActiveToolchains()
+	if err != nil {
+		return err
+	}
+	if active[toolchain.Kind] == toolchain.Name() {
+		delete(active, toolchain.Kind)
+		err = saveActiveToolchains(active)
+		if err != nil {
+			return err
+		}
+	}
+	return RemoveToolchainDir(toolchain)
+}
+
+// RemoveToolchainDir - Delete a toolchain's install directory
+func RemoveToolchainDir(toolchain *Toolchain) error {
+	err := toolchain.Validate()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(toolchain.Dir())
+}
+
+// LockToolchain - Lock a toolchain while it's (un)installed
+func LockToolchain(name string) (*FileLock, error) {
+	return Lock("toolchain-" + name)
+}
+
+// ActiveToolchains - The globally active toolchain name of each kind
+func ActiveToolchains() (map[string]string, error) {
+	active := map[string]string{}
+	data, err := ioutil.ReadFile(filepath.Join(GetToolchainsDir(), activeToolchainsName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return active, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &active)
+	return active, err
+}
+
+// UseToolchain - Make a toolchain the globally active one of its kind
+func UseToolchain(toolchain *Toolchain) error {
+	lock, err := Lock(activeToolchainsLock)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	active, err := ActiveToolchains()
+	if err != nil {
+		return err
+	}
+	active[toolchain.Kind] = toolchain.Name()
+	return saveActiveToolchains(active)
+}
+
+func saveActiveToolchains(active map[string]string) error {
+	data, err := json.MarshalIndent(active, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(GetToolchainsDir(), activeToolchainsName), data, 0600)
+}
+
+// ProjectToolchains - Toolchain names pinned in a project directory
+func ProjectToolchains(projectDir string) ([]string, error) {
+	names := []string{}
+	file, err := os.Open(filepath.Join(projectDir, ProjectToolchainFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return names, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+// UseProjectToolchain - Pin a toolchain in a project directory, replacing
+// any other pinned toolchain of the same kind
+func UseProjectToolchain(projectDir string, toolchain *Toolchain) error {
+	names, err := ProjectToolchains(projectDir)
+	if err != nil {
+		return err
+	}
+	pins := []string{}
+	for _, name := range names {
+		if kind, _, err := ParseToolchainName(name); err == nil && kind == toolchain.Kind {
+			continue
+		}
+		pins = append(pins, name)
+	}
+	pins = append(pins, toolchain.Name())
+	data := []byte(strings.Join(pins, "\n") + "\n")
+	return ioutil.WriteFile(filepath.Join(projectDir, ProjectToolchainFile), data, 0644)
+}
+
+// PinToolchains - Use these toolchains for the rest of this process
+func PinToolchains(names []string) error {
+	for _, name := range names {
+		kind, _, err := ParseToolchainName(name)
+		if err != nil {
+			return err
+		}
+		if _, err := GetToolchain(name); err != nil {
+			return err
+		}
+		pinned[kind] = name
+	}
+	return nil
+}
+
+// IsPinned - Was a toolchain of this kind pinned with PinToolchains()
+func IsPinned(kind string) bool {
+	_, ok := pinned[kind]
+	return ok
+}
+
+// projectPin - The toolchain of a kind pinned by the project (cwd), empty
+// if there's none
+func projectPin(kind string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	names, err := ProjectToolchains(cwd)
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		if pinKind, _, err := ParseToolchainName(name); err == nil && pinKind == kind {
+			return name
+		}
+	}
+	return ""
+}
+
+// ResolveToolchain - Pick a toolchain of a kind, in order of precedence:
+// pinned for this process, pinned by the project (cwd), globally active.
+// Returns nil if there's none.
+func ResolveToolchain(kind string) (*Toolchain, error) {
+	if name, ok := pinned[kind]; ok {
+		return GetToolchain(name)
+	}
+	cwd, err := os.Getwd()
+	if err == nil {
+		names, err := ProjectToolchains(cwd)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if pinKind, _, err := ParseToolchainName(name); err == nil && pinKind == kind {
+				return GetToolchain(name)
+			}
+		}
+	}
+	active, err := ActiveToolchains()
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := active[kind]; ok {
+		return GetToolchain(name)
+	}
+	return nil, nil
+}
@@ -14,14 +14,17 @@ package build
 */
 
 import (
-	"encoding/json"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/moloch--/denim/pkg/assets"
+	"github.com/moloch--/denim/pkg/logger"
 	"github.com/moloch--/denim/pkg/nim"
 	"github.com/moloch--/denim/pkg/ollvm"
 )
@@ -32,29 +35,144 @@ type Build struct {
 	NimFiles []string
 
 	Output     string
+	Defines    []string
 	ObfAllCode bool
+	ObfRules   []*Rule
+	Resources  []string
+	Target     *Target
+	ClangDir   string
 
-	Verbose bool
+	// NimArgs - Passed to nim before the nim files, CFlags are added to each
+	// C file's compile and LDFlags to the link
+	NimArgs []string
+	CFlags  []string
+	LDFlags []string
+
+	// App - Nim --app type, libraries can control their exports
+	App          string
+	DefFile      string
+	Exports      []string
+	StripNimMain bool
+
+	// Jobs - Max C files compiled in parallel
+	Jobs    int
+	NoCache bool
+
+	// WholeProgram - Merge every C file's bitcode and obfuscate it as one
+	// module, per-file rules don't apply
+	WholeProgram bool
+
+	// KeepWorkspace - Don't delete the nimcache of a successful build
+	KeepWorkspace bool
+
+	// EmitDir - Copy intermediate artifacts here, optionally with LLVM IR
+	EmitDir string
+	EmitIR  bool
+}
+
+// Result - What a build produced and how long each step took (seconds)
+type Result struct {
+	Output    string             `json:"output"`
+	SHA256    string             `json:"sha256"`
+	Size      int64              `json:"size"`
+	Workspace string             `json:"workspace,omitempty"`
+	Timings   map[string]float64 `json:"timings"`
+}
+
+// time - Record how long a step took
+func (r *Result) time(step string, started time.Time) {
+	r.Timings[step] = time.Since(started).Seconds()
 }
 
-// Compile a nim program with Obfuscator-LLVM
-func Compile(build *Build, obfArgs *ollvm.ObfArgs) error {
-	clang, err := ollvm.InitClang(assets.GetClangDir())
+// Compile a nim program with Obfuscator-LLVM, clang is the build's
+// toolchain (probed already, so it isn't probed again) or nil to use the
+// one in build.ClangDir
+func Compile(build *Build, clang *ollvm.Clang, obfArgs *ollvm.ObfArgs) (*Result, error) {
+	started := time.Now()
+	var err error
+	if clang == nil {
+		if build.ClangDir == "" {
+			build.ClangDir, err = assets.GetClangDir()
+			if err != nil {
+				return nil, err
+			}
+		}
+		clang, err = ollvm.InitClang(build.ClangDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = clang.Probe() // Cached on clang
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if 0 < len(obfArgs.Pipeline) {
+		err = clang.CheckPipeline(obfArgs.Pipeline)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !build.Target.IsHost() {
+		clang.Triple = build.Target.Triple
+		clang.Sysroot = build.Target.Sysroot
+	}
+	err = checkLibLinker(build, clang)
+	if err != nil {
+		return nil, err
+	}
+	if 0 < len(build.Resources) && build.Target.NimOS != "windows" {
+		return nil, fmt.Errorf("Resources only apply to Windows targets, not %s (%s)", build.Target.Name, strings.Join(build.Resources, ", "))
 	}
 
+	// Failed builds keep their workspace for debugging
+	workspace, err := NewWorkspace(build)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Timings: map[string]float64{}}
+	err = compile(build, clang, workspace.Dir, obfArgs, result)
+	if err != nil {
+		workspace.Close(true)
+		return nil, fmt.Errorf("%s\nBuild workspace: %s", err, workspace.Dir)
+	}
+	if build.KeepWorkspace {
+		result.Workspace = workspace.Dir
+		logger.Infof("Build workspace: %s\n", workspace.Dir)
+	}
+	err = workspace.Close(build.KeepWorkspace)
+	if err != nil {
+		return nil, err
+	}
+	result.SHA256, result.Size, err = hashFile(result.Output)
+	if err != nil {
+		return nil, err
+	}
+	result.time("total", started)
+	return result, nil
+}
+
+func compile(build *Build, clang *ollvm.Clang, nimCache string, obfArgs *ollvm.ObfArgs, result *Result) error {
+
 	// Compile Nim
-	nimCache, err := compileNimCode(build, clang)
+	started := time.Now()
+	err := compileNimCode(build, clang, nimCache)
 	if err != nil {
 		return err
 	}
-	nimProject, err := parseProjectJSON(nimCache)
+	result.time("nim", started)
+	nimProject, err := parseProjectJSON(nimCache, build)
 	if err != nil {
 		return err
 	}
+	result.Output = nimProject.OutputFile
 
 	// Compile C
+	policy := NewPolicy(build.ObfRules, obfArgs, build.ObfAllCode)
+	annotations, err := usesAnnotations(nimProject)
+	if err != nil {
+		return err
+	}
+	jobs := []*compileJob{}
 	for _, step := range nimProject.Compile {
 		if len(step) != 2 {
 			return fmt.Errorf("Malformed step: %v", step)
@@ -62,49 +180,118 @@ func Compile(build *Build, obfArgs *ollvm.ObfArgs) error {
 
 		cFile := filepath.Base(step[0])
 		compileCmd := strings.Fields(step[1])
-		if compileCmd[0] == "clang" || compileCmd[0] == "clang.exe" {
+		if isClangExe(compileCmd[0], clang) {
 			compileCmd = compileCmd[1:]
 		}
+		compileCmd = append(compileCmd, build.CFlags...)
 
-		var stdout []byte
-		var stderr []byte
-		var err error
-		if strings.HasPrefix(cFile, "@") || build.ObfAllCode {
-			stdout, stderr, err = clang.ObfCompile(nimCache, compileCmd, obfArgs)
-		} else {
-			stdout, stderr, err = clang.Compile(nimCache, compileCmd)
-		}
-		if build.Verbose {
-			if 0 < len(stdout) {
-				fmt.Printf(string(stdout))
-			}
-			if 0 < len(stderr) {
-				fmt.Printf(string(stderr))
+		fileObfArgs := policy.Match(cFile)
+		if fileObfArgs != nil {
+			if annotations {
+				// Only annotated functions of the files the policy obfuscates are
+				// obfuscated, with the pass options of the file's rule
+				fileObfArgs = ollvm.WithAnnotations(fileObfArgs)
 			}
+			fileObfArgs = fileObfArgs.ForFile(cFile)
 		}
-
+		jobs = append(jobs, &compileJob{
+			CFile:   cFile,
+			CSource: step[0],
+			Args:    compileCmd,
+			ObfArgs: fileObfArgs,
+		})
+	}
+	var cache *ObjectCache
+	if !build.NoCache {
+		nimVersion, err := nim.Version()
+		if err != nil {
+			return err
+		}
+		cache, err = NewObjectCache(assets.GetCacheDir(), clang, nimVersion)
 		if err != nil {
 			return err
 		}
 	}
+	if build.WholeProgram {
+		jobs = bitcodeJobs(jobs)
+	}
+	started = time.Now()
+	if build.EmitDir != "" {
+		err = emitSources(build, clang, nimCache, jobs)
+		if err != nil {
+			return err
+		}
+	}
+	err = runCompileJobs(clang, nimCache, jobs, cache, build.Jobs)
+	if err != nil {
+		return err
+	}
+	if build.EmitDir != "" {
+		err = emitObjects(build, clang, nimCache, jobs)
+		if err != nil {
+			return err
+		}
+	}
+	if build.WholeProgram {
+		wholeObfArgs := obfArgs
+		if annotations {
+			wholeObfArgs = ollvm.WithAnnotations(obfArgs)
+		}
+		err = compileWholeProgram(build, clang, nimCache, nimProject, jobs, wholeObfArgs.ForFile(build.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	result.time("c", started)
+
+	started = time.Now()
+	if build.App == AppStaticLib {
+		err = archive(build, clang, nimCache, nimProject)
+	} else {
+		err = link(build, clang, nimCache, nimProject)
+	}
+	if err != nil {
+		return err
+	}
+	result.time("link", started)
+	return nil
+}
 
+// link - Link the compiled objects into an executable or shared library
+func link(build *Build, clang *ollvm.Clang, nimCache string, nimProject *nim.Project) error {
 	linker := []string{"-o", nimProject.OutputFile}
+	resources := append([]string{}, build.Resources...)
 	for _, link := range nimProject.Link {
-		if strings.HasSuffix(link, ".res") {
+		if isResource(link) {
+			resources = append(resources, link)
 			continue
 		}
 		linker = append(linker, link)
 	}
-	linker = append(linker, "-g")
-	stdout, stderr, err := clang.Compile(nimCache, linker)
-	if build.Verbose {
-		if 0 < len(stdout) {
-			fmt.Printf(string(stdout))
+	resourceObjs, err := compileResources(build, clang, nimCache, resources)
+	if err != nil {
+		return err
+	}
+	linker = append(linker, resourceObjs...)
+	if build.App == AppLib {
+		libFlags, err := libLinkFlags(build, nimCache)
+		if err != nil {
+			return err
 		}
-		if 0 < len(stderr) {
-			fmt.Printf(string(stderr))
+		linker = append(linker, libFlags...)
+	}
+	linker = append(linker, build.Target.LinkFlags...)
+	linker = append(linker, build.LDFlags...)
+	linker = append(linker, "-g")
+	if build.EmitDir != "" {
+		err = emitLinkCommand(build, clang.ClangExe, clang.CompileArgs(linker))
+		if err != nil {
+			return err
 		}
 	}
+	stdout, stderr, err := clang.Compile(nimCache, linker)
+	logger.Output(stdout, stderr)
 	if err != nil {
 		return err
 	}
@@ -113,52 +300,139 @@ func Compile(build *Build, obfArgs *ollvm.ObfArgs) error {
 }
 
 // nim compile --genScript --compileOnly --cc=clang --clang.exe:PATH --nimcache:PATH helloworld.nim
-func compileNimCode(build *Build, clang *ollvm.Clang) (string, error) {
-	nimCache := filepath.Join(assets.GetNimCacheRoot(), build.Name)
-	if _, err := os.Stat(nimCache); !os.IsNotExist(err) {
-		err := os.RemoveAll(nimCache)
-		if err != nil {
-			return "", err
-		}
-	}
+func compileNimCode(build *Build, clang *ollvm.Clang, nimCache string) error {
 	args := []string{"--genScript", "--compileOnly", "--cc:clang"}
 	args = append(args, fmt.Sprintf("--clang.exe=%s", clang.ClangExe))
 	args = append(args, fmt.Sprintf("--nimcache:%s", nimCache))
+	nimLib := assets.GetNimLibDir()
+	err := nim.InstallModule(nimLib)
+	if err != nil {
+		return err
+	}
+	args = append(args, fmt.Sprintf("--path:%s", nimLib))
+	args = append(args, fmt.Sprintf("--os:%s", build.Target.NimOS))
+	args = append(args, fmt.Sprintf("--cpu:%s", build.Target.NimCPU))
+	if build.App != "" {
+		args = append(args, fmt.Sprintf("--app:%s", build.App))
+	}
+	if build.App == AppStaticLib {
+		args = append(args, fmt.Sprintf("--header:%s", headerName(build)))
+	}
 	if build.Output != "" {
 		args = append(args, fmt.Sprintf("--out:%s", build.Output))
 	}
+	for _, define := range build.Defines {
+		args = append(args, fmt.Sprintf("--define:%s", define))
+	}
+	args = append(args, build.NimArgs...)
 	args = append(args, build.NimFiles...)
 
 	workDir, _ := os.Getwd()
 	stdout, stderr, err := nim.Compile(workDir, os.Environ(), args)
-	if build.Verbose {
-		if 0 < len(stdout) {
-			fmt.Printf(string(stdout))
+	logger.Output(stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("Nim compile failed (%s)\n%s", err, stderr)
+	}
+	return nil
+}
+
+// isResource - Windows resource script or compiled resource
+func isResource(fileName string) bool {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	return ext == ".rc" || ext == ".res"
+}
+
+// compileResources - Compile resources to objects for the linker, resources
+// only mean something to Windows targets so they're ignored otherwise
+func compileResources(build *Build, clang *ollvm.Clang, nimCache string, resources []string) ([]string, error) {
+	objs := []string{}
+	if build.Target.NimOS != "windows" {
+		if 0 < len(resources) {
+			logger.Warnf("Ignoring resources linked by the code, they only apply to Windows targets (%s)\n", strings.Join(resources, ", "))
 		}
-		if 0 < len(stderr) {
-			fmt.Printf(string(stderr))
+		return objs, nil
+	}
+	for index, resource := range resources {
+		if !filepath.IsAbs(resource) {
+			workDir, _ := os.Getwd()
+			resource = filepath.Join(workDir, resource)
 		}
+		obj := filepath.Join(nimCache, fmt.Sprintf("resource%d_%s.o", index, filepath.Base(resource)))
+		stdout, stderr, err := clang.CompileResource(nimCache, resource, obj)
+		logger.Output(stdout, stderr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile resource %s: %s\n%s", resource, err, stderr)
+		}
+		objs = append(objs, obj)
 	}
+	return objs, nil
+}
 
-	return nimCache, err
+// usesAnnotations - Does any of the project's C code use obf pragmas
+func usesAnnotations(nimProject *nim.Project) (bool, error) {
+	for _, step := range nimProject.Compile {
+		if len(step) != 2 {
+			return false, fmt.Errorf("Malformed step: %v", step)
+		}
+		annotated, err := ollvm.UsesAnnotations(step[0])
+		if err != nil {
+			return false, err
+		}
+		if annotated {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func parseProjectJSON(nimCache string) (*nim.Project, error) {
-	entries, err := ioutil.ReadDir(nimCache)
-	if err != nil {
-		return nil, err
+// isClangExe - Nim prefixes each compile command with the value of --clang.exe
+func isClangExe(arg string, clang *ollvm.Clang) bool {
+	if arg == clang.ClangExe {
+		return true
 	}
-	for _, entry := range entries {
-		entryPath := filepath.Join(nimCache, entry.Name())
-		if strings.HasSuffix(entryPath, ".json") {
-			data, err := ioutil.ReadFile(entryPath)
-			if err != nil {
-				return nil, err
+	name := filepath.Base(strings.Trim(arg, "\"'"))
+	return name == "clang" || name == "clang.exe"
+}
+
+// parseProjectJSON - Nim names the build instructions after the project
+func parseProjectJSON(nimCache string, build *Build) (*nim.Project, error) {
+	name := strings.TrimSuffix(build.Name, filepath.Ext(build.Name)) + ".json"
+	projectJSON := filepath.Join(nimCache, name)
+	data, err := ioutil.ReadFile(projectJSON)
+	if os.IsNotExist(err) {
+		found := []string{}
+		entries, _ := ioutil.ReadDir(nimCache)
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".json") {
+				found = append(found, entry.Name())
 			}
-			project := &nim.Project{}
-			err = json.Unmarshal(data, project)
-			return project, err
 		}
+		return nil, fmt.Errorf("Nim did not write build instructions to %s (found %v), check nim's output with --verbose", projectJSON, found)
+	}
+	if err != nil {
+		return nil, err
+	}
+	project, err := nim.ParseProject(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nim build instructions %s: %s", projectJSON, err)
+	}
+	if len(project.Compile) == 0 {
+		return nil, fmt.Errorf("Nim build instructions %s have nothing to compile", projectJSON)
+	}
+	return project, nil
+}
+
+// hashFile - SHA256 and size of a file
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	size, err := io.Copy(digest, file)
+	if err != nil {
+		return "", 0, err
 	}
-	return nil, nil
+	return fmt.Sprintf("%x", digest.Sum(nil)), size, nil
 }
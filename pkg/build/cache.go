@@ -0,0 +1,245 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+const (
+	// workDirPlaceholder - Replaces the nimcache path in cache keys, so keys
+	// don't depend on where a build happened
+	workDirPlaceholder = "<nimcache>"
+)
+
+// ObjectCache - Content addressed cache of compiled objects, keyed by
+// everything that goes in to an object
+type ObjectCache struct {
+	Dir string
+
+	// identity - Toolchain and nim versions
+	identity string
+}
+
+// NewObjectCache - Cache objects produced by clang in dir
+func NewObjectCache(dir string, clang *ollvm.Clang, nimVersion string) (*ObjectCache, error) {
+	clangIdentity, err := clang.Identity()
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectCache{
+		Dir:      dir,
+		identity: fmt.Sprintf("%s|%s", clangIdentity, nimVersion),
+	}, nil
+}
+
+// Key - Hash of the C source, clang argv, obfuscation args (including the
+// file's seed), and toolchain. The headers the source includes are added by
+// ObjectKey, since they're only known after the source is compiled.
+func (c *ObjectCache) Key(wd string, cSource string, argv []string, obfArgs *ollvm.ObfArgs) (string, error) {
+	digest := sha256.New()
+	fmt.Fprintf(digest, "identity:%s\n", c.identity)
+	source, err := os.Open(cSource)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	io.WriteString(digest, "source:")
+	if _, err := io.Copy(digest, source); err != nil {
+		return "", err
+	}
+	io.WriteString(digest, "\nargv:")
+	for _, arg := range argv {
+		fmt.Fprintf(digest, "%q ", strings.ReplaceAll(arg, wd, workDirPlaceholder))
+	}
+	obfData, err := json.Marshal(obfArgs)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(digest, "\nobf:%s\n", obfData)
+	return fmt.Sprintf("%x", digest.Sum(nil)), nil
+}
+
+// ObjectKey - Hash of the key and the contents of every header the source
+// included when it was last compiled (see SaveDeps), an error if the
+// headers are unknown or one is gone
+func (c *ObjectCache) ObjectKey(wd string, key string) (string, error) {
+	data, err := ioutil.ReadFile(c.depsPath(key))
+	if err != nil {
+		return "", err
+	}
+	deps := []string{}
+	err = json.Unmarshal(data, &deps)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.New()
+	fmt.Fprintf(digest, "key:%s\n", key)
+	for _, dep := range deps {
+		depData, err := ioutil.ReadFile(strings.ReplaceAll(dep, workDirPlaceholder, wd))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(digest, "%q:%x\n", dep, sha256.Sum256(depData))
+	}
+	return fmt.Sprintf("%x", digest.Sum(nil)), nil
+}
+
+// SaveDeps - Record the headers a source included, relative paths are
+// relative to wd
+func (c *ObjectCache) SaveDeps(wd string, key string, deps []string) error {
+	relDeps := []string{}
+	for _, dep := range deps {
+		if !filepath.IsAbs(dep) {
+			dep = filepath.Join(wd, dep)
+		}
+		relDeps = append(relDeps, strings.ReplaceAll(dep, wd, workDirPlaceholder))
+	}
+	data, err := json.Marshal(relDeps)
+	if err != nil {
+		return err
+	}
+	return c.write(c.depsPath(key), func(tmpFile string) error {
+		return ioutil.WriteFile(tmpFile, data, 0600)
+	})
+}
+
+// Get - Copy a cached object to dest, returns false on a miss
+func (c *ObjectCache) Get(key string, dest string) bool {
+	return copyFile(c.path(key), dest) == nil
+}
+
+// Put - Add an object to the cache
+func (c *ObjectCache) Put(key string, src string) error {
+	return c.write(c.path(key), func(tmpFile string) error {
+		return copyFile(src, tmpFile)
+	})
+}
+
+// write - Write then rename, so a concurrent reader never sees a partial file
+func (c *ObjectCache) write(cachePath string, writeFile func(string) error) error {
+	err := os.MkdirAll(filepath.Dir(cachePath), 0700)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cachePath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	err = writeFile(tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), cachePath)
+}
+
+func (c *ObjectCache) path(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".o")
+}
+
+func (c *ObjectCache) depsPath(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".deps")
+}
+
+// depsArgs - Rewrite compile args to list the source's dependencies (make
+// format) on stdout instead of compiling
+func depsArgs(args []string) []string {
+	deps := []string{}
+	for index := 0; index < len(args); index++ {
+		if args[index] == "-o" {
+			index++
+			continue
+		}
+		deps = append(deps, args[index])
+	}
+	return append(deps, "-M")
+}
+
+// parseDeps - The prerequisites of a make rule from 'clang -M', except the
+// source itself which is already part of the key. Clang escapes spaces and
+// '#' with a backslash and '$' as '$$'.
+func parseDeps(output []byte, cSource string) []string {
+	rule := strings.ReplaceAll(string(output), "\\\r\n", " ")
+	rule = strings.ReplaceAll(rule, "\\\n", " ")
+	if index := strings.Index(rule, ": "); 0 <= index {
+		rule = rule[index+2:]
+	}
+	deps := []string{}
+	dep := ""
+	chars := []rune(rule)
+	for index := 0; index < len(chars); index++ {
+		char := chars[index]
+		switch {
+		case char == '\\' && index+1 < len(chars) && (chars[index+1] == ' ' || chars[index+1] == '#'):
+			index++
+			dep += string(chars[index])
+		case char == '$' && index+1 < len(chars) && chars[index+1] == '$':
+			index++
+			dep += "$"
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			if dep != "" && dep != cSource {
+				deps = append(deps, dep)
+			}
+			dep = ""
+		default:
+			dep += string(char)
+		}
+	}
+	if dep != "" && dep != cSource {
+		deps = append(deps, dep)
+	}
+	return deps
+}
+
+// objectPath - Find the object file a compile command outputs
+func objectPath(wd string, args []string) string {
+	for index, arg := range args {
+		if arg == "-o" && index+1 < len(args) {
+			output := strings.Trim(args[index+1], "\"'")
+			if !filepath.IsAbs(output) {
+				output = filepath.Join(wd, output)
+			}
+			return output
+		}
+	}
+	return ""
+}
+
+func copyFile(src string, dest string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destFile, srcFile)
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
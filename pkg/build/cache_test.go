@@ -0,0 +1,132 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDeps(t *testing.T) {
+	source := "/cache/@mmain.nim.c"
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			name:   "one line",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c /nim/lib/nimbase.h\n",
+			want:   []string{"/nim/lib/nimbase.h"},
+		},
+		{
+			name:   "continuations",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c \\\n  /nim/lib/nimbase.h \\\n  /usr/include/stdio.h\n",
+			want:   []string{"/nim/lib/nimbase.h", "/usr/include/stdio.h"},
+		},
+		{
+			name:   "windows continuations",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c \\\r\n  C:\\nim\\lib\\nimbase.h\r\n",
+			want:   []string{"C:\\nim\\lib\\nimbase.h"},
+		},
+		{
+			name:   "escaped spaces",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c /my\\ project/lib\\ dir/crypto.h\n",
+			want:   []string{"/my project/lib dir/crypto.h"},
+		},
+		{
+			name:   "escaped hash",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c /src/c\\#/api.h\n",
+			want:   []string{"/src/c#/api.h"},
+		},
+		{
+			name:   "dollars",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c /src/$$HOME/a$$b.h /src/$$\n",
+			want:   []string{"/src/$HOME/a$b.h", "/src/$"},
+		},
+		{
+			name:   "no headers",
+			output: "@mmain.nim.c.o: /cache/@mmain.nim.c\n",
+			want:   []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseDeps([]byte(test.output), source)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseDeps()\n got: %q\nwant: %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDepsArgs(t *testing.T) {
+	got := depsArgs([]string{"-c", "-w", "-o", "/cache/@mmain.nim.c.o", "/cache/@mmain.nim.c"})
+	want := []string{"-c", "-w", "/cache/@mmain.nim.c", "-M"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("depsArgs()\n got: %q\nwant: %q", got, want)
+	}
+}
+
+// TestObjectKey - Changing a header the source includes changes the key,
+// headers in the workspace are found in a later build's workspace
+func TestObjectKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "denim-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &ObjectCache{Dir: filepath.Join(dir, "cache"), identity: "test"}
+	header := filepath.Join(dir, "nimbase.h")
+	wd := filepath.Join(dir, "nimcache")
+	os.MkdirAll(wd, 0700)
+	ioutil.WriteFile(header, []byte("#define N_NIMCALL"), 0600)
+	ioutil.WriteFile(filepath.Join(wd, "gen.h"), []byte("int gen;"), 0600)
+
+	key := "0123456789abcdef"
+	if _, err := cache.ObjectKey(wd, key); err == nil {
+		t.Fatalf("ObjectKey() without saved deps should fail")
+	}
+	err = cache.SaveDeps(wd, key, []string{header, "gen.h"})
+	if err != nil {
+		t.Fatalf("SaveDeps() error: %s", err)
+	}
+	before, err := cache.ObjectKey(wd, key)
+	if err != nil {
+		t.Fatalf("ObjectKey() error: %s", err)
+	}
+
+	nextWd := filepath.Join(dir, "nimcache2")
+	os.Rename(wd, nextWd)
+	if again, err := cache.ObjectKey(nextWd, key); err != nil || again != before {
+		t.Fatalf("ObjectKey() in a new workspace got: %s (%v), want: %s", again, err, before)
+	}
+
+	ioutil.WriteFile(header, []byte("#define N_NIMCALL(rettype, name) rettype name"), 0600)
+	after, err := cache.ObjectKey(nextWd, key)
+	if err != nil {
+		t.Fatalf("ObjectKey() error: %s", err)
+	}
+	if after == before {
+		t.Fatalf("ObjectKey() did not change when a header changed")
+	}
+
+	os.Remove(header)
+	if _, err := cache.ObjectKey(nextWd, key); err == nil {
+		t.Fatalf("ObjectKey() with a missing header should fail")
+	}
+}
@@ -0,0 +1,165 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+const (
+	emitSourceDir = "c"
+	emitObjectDir = "obj"
+	emitIRDir     = "ir"
+)
+
+// compileCommand - An entry of a clang JSON compilation database
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	Arguments []string `json:"arguments"`
+	File      string   `json:"file"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// emitSources - Copy the generated C code, nim's build instructions, and
+// the clang command of each file (compile_commands.json) to the emit dir,
+// this happens before compiling so it's available if clang fails
+func emitSources(build *Build, clang *ollvm.Clang, nimCache string, jobs []*compileJob) error {
+	sourceDir := filepath.Join(build.EmitDir, emitSourceDir)
+	err := os.MkdirAll(sourceDir, 0700)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(nimCache)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".c" && ext != ".h" && ext != ".json") {
+			continue
+		}
+		dest := filepath.Join(sourceDir, entry.Name())
+		if ext == ".json" {
+			dest = filepath.Join(build.EmitDir, entry.Name())
+		}
+		err = copyFile(filepath.Join(nimCache, entry.Name()), dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	commands := []*compileCommand{}
+	for _, job := range jobs {
+		argv := clang.CompileArgs(job.Args)
+		if job.ObfArgs != nil {
+			argv, err = clang.ObfCompileArgs(job.Args, job.ObfArgs)
+			if err != nil {
+				return err
+			}
+		}
+		commands = append(commands, &compileCommand{
+			Directory: nimCache,
+			Arguments: append([]string{clang.ClangExe}, argv...),
+			File:      job.CSource,
+			Output:    objectPath(nimCache, job.Args),
+		})
+	}
+	return writeJSON(filepath.Join(build.EmitDir, "compile_commands.json"), commands)
+}
+
+// emitObjects - Copy the compiled objects, and dump the LLVM IR of each
+// file before and after obfuscation if requested
+func emitObjects(build *Build, clang *ollvm.Clang, nimCache string, jobs []*compileJob) error {
+	objectDir := filepath.Join(build.EmitDir, emitObjectDir)
+	err := os.MkdirAll(objectDir, 0700)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		object := objectPath(nimCache, job.Args)
+		if object == "" {
+			continue
+		}
+		err = copyFile(object, filepath.Join(objectDir, filepath.Base(object)))
+		if err != nil {
+			return err
+		}
+	}
+	if !build.EmitIR {
+		return nil
+	}
+
+	irDir := filepath.Join(build.EmitDir, emitIRDir)
+	err = os.MkdirAll(irDir, 0700)
+	if err != nil {
+		return err
+	}
+	irJobs := []*compileJob{}
+	for _, job := range jobs {
+		if job.ObfArgs == nil {
+			irJobs = append(irJobs, irJob(job, filepath.Join(irDir, job.CFile+".ll"), nil))
+			continue
+		}
+		irJobs = append(irJobs, irJob(job, filepath.Join(irDir, job.CFile+".before.ll"), nil))
+		irJobs = append(irJobs, irJob(job, filepath.Join(irDir, job.CFile+".after.ll"), job.ObfArgs))
+	}
+	return runCompileJobs(clang, nimCache, irJobs, nil, build.Jobs)
+}
+
+// emitLinkCommand - Record the final link (or archive) command
+func emitLinkCommand(build *Build, exe string, argv []string) error {
+	quoted := []string{fmt.Sprintf("%q", exe)}
+	for _, arg := range argv {
+		quoted = append(quoted, fmt.Sprintf("%q", arg))
+	}
+	data := []byte(strings.Join(quoted, " ") + "\n")
+	return ioutil.WriteFile(filepath.Join(build.EmitDir, "link_command.txt"), data, 0600)
+}
+
+// irJob - Compile a job to textual LLVM IR instead of an object
+func irJob(job *compileJob, output string, obfArgs *ollvm.ObfArgs) *compileJob {
+	args := []string{"-S", "-emit-llvm"}
+	for index := 0; index < len(job.Args); index++ {
+		switch job.Args[index] {
+		case "-c":
+			continue
+		case "-o":
+			index++ // Skip the object path
+			continue
+		}
+		args = append(args, job.Args[index])
+	}
+	args = append(args, "-o", output)
+	return &compileJob{
+		CFile:   filepath.Base(output),
+		CSource: job.CSource,
+		Args:    args,
+		ObfArgs: obfArgs,
+	}
+}
+
+func writeJSON(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,183 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/moloch--/denim/pkg/logger"
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+// compileJob - A single C file to compile, nil ObfArgs means no obfuscation
+type compileJob struct {
+	CFile   string
+	CSource string
+	Args    []string
+	ObfArgs *ollvm.ObfArgs
+}
+
+type compileResult struct {
+	Stdout []byte
+	Stderr []byte
+	Err    error
+
+	// Canceled - The job was killed or skipped because another job failed
+	Canceled bool
+
+	// Cached - The object was copied from the object cache
+	Cached bool
+}
+
+// runCompileJobs - Compile C files with a bounded pool of workers, the first
+// failure cancels any remaining jobs. Output is displayed in job order and
+// the error of the first failed job (in job order) is returned, so the
+// result doesn't depend on scheduling. A nil cache disables caching.
+func runCompileJobs(clang *ollvm.Clang, wd string, jobs []*compileJob, cache *ObjectCache, workers int) error {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make([]*compileResult, len(jobs))
+	done := make([]chan struct{}, len(jobs))
+	for index := range jobs {
+		done[index] = make(chan struct{})
+	}
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				results[index] = runCompileJob(ctx, clang, wd, jobs[index], cache)
+				if results[index].Err != nil && !results[index].Canceled {
+					cancel()
+				}
+				close(done[index])
+			}
+		}()
+	}
+	go func() {
+		for index := range jobs {
+			queue <- index
+		}
+		close(queue)
+	}()
+
+	var firstErr error
+	for index, job := range jobs {
+		<-done[index]
+		result := results[index]
+		if result.Canceled {
+			continue
+		}
+		displayJobOutput(job, result)
+		if result.Err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Failed to compile %s: %s\n%s", job.CFile, result.Err, result.Stderr)
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func runCompileJob(ctx context.Context, clang *ollvm.Clang, wd string, job *compileJob, cache *ObjectCache) *compileResult {
+	if ctx.Err() != nil {
+		return &compileResult{Err: ctx.Err(), Canceled: true}
+	}
+
+	cacheKey := ""
+	object := objectPath(wd, job.Args)
+	if cache != nil && object != "" {
+		cacheKey = jobCacheKey(clang, wd, job, cache)
+		if cacheKey != "" {
+			objectKey, err := cache.ObjectKey(wd, cacheKey)
+			if err == nil && cache.Get(objectKey, object) {
+				return &compileResult{Cached: true}
+			}
+		}
+	}
+
+	var stdout []byte
+	var stderr []byte
+	var err error
+	if job.ObfArgs != nil {
+		stdout, stderr, err = clang.ObfCompileContext(ctx, wd, job.Args, job.ObfArgs)
+	} else {
+		stdout, stderr, err = clang.CompileContext(ctx, wd, job.Args)
+	}
+	if err == nil && cacheKey != "" {
+		cacheObject(ctx, clang, wd, job, cache, cacheKey, object) // A failure just means a miss next time
+	}
+	return &compileResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		Err:      err,
+		Canceled: err != nil && ctx.Err() != nil,
+	}
+}
+
+// cacheObject - Record the headers the source includes, so changing any of
+// them is a miss, then add the object to the cache
+func cacheObject(ctx context.Context, clang *ollvm.Clang, wd string, job *compileJob, cache *ObjectCache, key string, object string) error {
+	stdout, stderr, err := clang.CompileContext(ctx, wd, depsArgs(job.Args))
+	if err != nil {
+		return fmt.Errorf("Failed to list dependencies of %s (%s) %s", job.CFile, err, stderr)
+	}
+	err = cache.SaveDeps(wd, key, parseDeps(stdout, job.CSource))
+	if err != nil {
+		return err
+	}
+	objectKey, err := cache.ObjectKey(wd, key)
+	if err != nil {
+		return err
+	}
+	return cache.Put(objectKey, object)
+}
+
+// jobCacheKey - Empty if the job can't be cached, which lets the compile
+// report any error
+func jobCacheKey(clang *ollvm.Clang, wd string, job *compileJob, cache *ObjectCache) string {
+	argv := clang.CompileArgs(job.Args)
+	if job.ObfArgs != nil {
+		var err error
+		argv, err = clang.ObfCompileArgs(job.Args, job.ObfArgs)
+		if err != nil {
+			return ""
+		}
+	}
+	key, err := cache.Key(wd, job.CSource, argv, job.ObfArgs)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// displayJobOutput - Display a job's output as one block (at debug level)
+func displayJobOutput(job *compileJob, result *compileResult) {
+	if result.Cached {
+		logger.Debugf("%s (cached)\n", job.CFile)
+		return
+	}
+	if len(result.Stdout) == 0 && len(result.Stderr) == 0 {
+		return
+	}
+	logger.Debugf("%s\n", job.CFile)
+	logger.Output(result.Stdout, result.Stderr)
+}
@@ -0,0 +1,158 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+const (
+	// AppConsole - Console executable (nim's default)
+	AppConsole = "console"
+	// AppGUI - GUI executable
+	AppGUI = "gui"
+	// AppLib - Shared library (DLL/.so)
+	AppLib = "lib"
+
+	// nimMain - Nim exports its runtime initialization from libraries
+	nimMain = "NimMain"
+)
+
+// AppTypes - Supported --app values
+var AppTypes = []string{AppConsole, AppGUI, AppLib, AppStaticLib}
+
+// checkLibLinker - Stripping NimMain from a DLL needs a linker that has
+// --exclude-symbols, which older mingw-w64 binutils don't, so check before
+// spending time on the build
+func checkLibLinker(build *Build, clang *ollvm.Clang) error {
+	if build.App != AppLib || !build.StripNimMain || build.Target.NimOS != "windows" {
+		return nil
+	}
+	workDir, _ := os.Getwd()
+	flags := append(append([]string{}, build.Target.LinkFlags...), build.LDFlags...)
+	help, err := clang.LinkerHelp(workDir, flags)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(help, "--exclude-symbols") {
+		return fmt.Errorf("Stripping %s from a DLL needs a linker with --exclude-symbols (binutils 2.40+ or lld 16+), use a newer mingw-w64, add '-fuse-ld=lld' to --ldflags if your toolchain has lld 16+, or drop --strip-nim-main", nimMain)
+	}
+	return nil
+}
+
+// libLinkFlags - Flags to link a shared library and control its exports,
+// with a .def file (Windows) or a version script (Linux)
+func libLinkFlags(build *Build, nimCache string) ([]string, error) {
+	flags := []string{"-shared"}
+	if build.Target.NimOS == "windows" {
+		if build.DefFile != "" {
+			flags = append(flags, build.DefFile)
+		} else if 0 < len(build.Exports) {
+			defFile := filepath.Join(nimCache, "exports.def")
+			data := "EXPORTS\n" + strings.Join(build.Exports, "\n") + "\n"
+			err := ioutil.WriteFile(defFile, []byte(data), 0600)
+			if err != nil {
+				return nil, err
+			}
+			flags = append(flags, defFile)
+		}
+		if build.StripNimMain {
+			flags = append(flags, fmt.Sprintf("-Wl,--exclude-symbols,%s", nimMain))
+		}
+		return flags, nil
+	}
+
+	exports := append([]string{}, build.Exports...)
+	if build.DefFile != "" {
+		defExports, err := parseDefExports(build.DefFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(defExports) == 0 {
+			return nil, fmt.Errorf("No exports found in %s, expected an EXPORTS section", build.DefFile)
+		}
+		exports = append(exports, defExports...)
+	}
+	if len(exports) == 0 && !build.StripNimMain {
+		return flags, nil
+	}
+	versionScript := filepath.Join(nimCache, "exports.map")
+	script := "{\n"
+	if 0 < len(exports) {
+		script += "  global: " + strings.Join(exports, "; ") + ";\n"
+		if !build.StripNimMain {
+			script += fmt.Sprintf("  global: %s;\n", nimMain)
+		}
+		script += "  local: *;\n"
+	} else {
+		script += "  global: *;\n"
+		script += fmt.Sprintf("  local: %s;\n", nimMain)
+	}
+	script += "};\n"
+	err := ioutil.WriteFile(versionScript, []byte(script), 0600)
+	if err != nil {
+		return nil, err
+	}
+	flags = append(flags, fmt.Sprintf("-Wl,--version-script=%s", versionScript))
+	return flags, nil
+}
+
+// parseDefExports - Symbol names from the EXPORTS section of a .def file
+func parseDefExports(defFile string) ([]string, error) {
+	file, err := os.Open(defFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	exports := []string{}
+	inExports := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), ";", 2)[0])
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.ToUpper(fields[0]) == "EXPORTS" {
+			inExports = true
+			fields = fields[1:]
+			if len(fields) == 0 {
+				continue
+			}
+		} else if isDefKeyword(fields[0]) {
+			inExports = false
+			continue
+		}
+		if inExports {
+			// name[=internal] [@ordinal] [NONAME] [DATA] [PRIVATE]
+			exports = append(exports, strings.Trim(strings.SplitN(fields[0], "=", 2)[0], "\"'"))
+		}
+	}
+	return exports, scanner.Err()
+}
+
+func isDefKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "LIBRARY", "NAME", "DESCRIPTION", "STACKSIZE", "HEAPSIZE", "SECTIONS", "VERSION", "IMPORTS":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDefExports(t *testing.T) {
+	tests := []struct {
+		name string
+		def  string
+		want []string
+	}{
+		{
+			name: "exports",
+			def:  "LIBRARY payload\nEXPORTS\n    DllRegisterServer\n    Run\n",
+			want: []string{"DllRegisterServer", "Run"},
+		},
+		{
+			name: "same line",
+			def:  "EXPORTS Run\n  Stop\n",
+			want: []string{"Run", "Stop"},
+		},
+		{
+			name: "ordinals",
+			def:  "EXPORTS\n  Run @1\n  Stop @2 NONAME\n  Data @3 DATA\n  Hidden PRIVATE\n",
+			want: []string{"Run", "Stop", "Data", "Hidden"},
+		},
+		{
+			name: "aliases",
+			def:  "EXPORTS\n  Run=RunImpl @1\n  Stop = StopImpl\n  Start@8\n  \"Quoted\"\n",
+			want: []string{"Run", "Stop", "Start@8", "Quoted"},
+		},
+		{
+			name: "comments",
+			def:  "; exports.def\nLIBRARY payload ; the dll\nEXPORTS ; start\n  ; Commented\n  Run ; the entry point\n\n  Stop\n",
+			want: []string{"Run", "Stop"},
+		},
+		{
+			name: "sections",
+			def:  "exports\n  Run\nSECTIONS\n  .text READ EXECUTE\nEXPORTS\n  Stop\nVERSION 1.0\n",
+			want: []string{"Run", "Stop"},
+		},
+		{
+			name: "no exports",
+			def:  "LIBRARY payload\nDESCRIPTION \"nothing\"\n",
+			want: []string{},
+		},
+	}
+	dir, err := ioutil.TempDir("", "denim-def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defFile := filepath.Join(dir, "exports.def")
+			err := ioutil.WriteFile(defFile, []byte(test.def), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseDefExports(defFile)
+			if err != nil {
+				t.Fatalf("parseDefExports() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseDefExports()\n got: %q\nwant: %q", got, test.want)
+			}
+		})
+	}
+
+	if _, err := parseDefExports(filepath.Join(dir, "missing.def")); err == nil {
+		t.Fatalf("parseDefExports() of a missing file should fail")
+	}
+}
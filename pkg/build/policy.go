@@ -0,0 +1,221 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+const (
+	// PolicyNone - Do not obfuscate matching files
+	PolicyNone = "none"
+	// PolicyDefault - Obfuscate matching files with the build's settings
+	PolicyDefault = "default"
+	// PolicyMax - Obfuscate matching files with every pass at its maximum
+	PolicyMax = "max"
+)
+
+var (
+	rulePasses = []string{
+		ollvm.OptBCF, ollvm.OptSub, ollvm.OptFlatten,
+		ollvm.OptStringEncryption, ollvm.OptConstantEncryption,
+	}
+)
+
+// Rule - Obfuscation settings for the C files matching a glob, a nil
+// ObfArgs means no obfuscation
+type Rule struct {
+	Pattern string
+	ObfArgs *ollvm.ObfArgs
+}
+
+// Policy - Ordered obfuscation rules, the first matching rule wins
+type Policy struct {
+	Rules []*Rule
+}
+
+// NewPolicy - User rules take precedence over the default policy; obfuscate
+// the project's own modules (@m*) and everything else only if allCode is set
+func NewPolicy(rules []*Rule, obfArgs *ollvm.ObfArgs, allCode bool) *Policy {
+	policy := &Policy{Rules: []*Rule{}}
+	policy.Rules = append(policy.Rules, rules...)
+	policy.Rules = append(policy.Rules, &Rule{Pattern: "@*", ObfArgs: obfArgs})
+	if allCode {
+		policy.Rules = append(policy.Rules, &Rule{Pattern: "*", ObfArgs: obfArgs})
+	}
+	return policy
+}
+
+// Match - Get the obfuscation settings for a C file, nil if it should not be
+// obfuscated
+func (p *Policy) Match(cFile string) *ollvm.ObfArgs {
+	for _, rule := range p.Rules {
+		if rule.Matches(cFile) {
+			return rule.ObfArgs
+		}
+	}
+	return nil
+}
+
+// Matches - Match against the C file name, with or without its extensions
+// so @mcrypto, @mcrypto.nim, and @mcrypto.nim.c all match @mcrypto.nim.c
+func (r *Rule) Matches(cFile string) bool {
+	name := filepath.Base(cFile)
+	names := []string{name, strings.TrimSuffix(name, ".c")}
+	names = append(names, strings.TrimSuffix(names[1], ".nim"))
+	for _, name := range names {
+		if matched, _ := filepath.Match(r.Pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRule - Parse a <glob>=<settings> rule, settings are one of none,
+// default, max, or a list of passes with optional loop/split counts e.g.
+// "fla:3,bcf,strcry", unlisted passes are disabled and counts not given
+// are taken from defaults
+func ParseRule(spec string, defaults *ollvm.ObfArgs) (*Rule, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid rule '%s', expected <glob>=<settings>", spec)
+	}
+	if _, err := filepath.Match(parts[0], ""); err != nil {
+		return nil, fmt.Errorf("Invalid rule glob '%s': %s", parts[0], err)
+	}
+	obfArgs, err := ParseObfSettings(parts[1], defaults)
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{Pattern: parts[0], ObfArgs: obfArgs}, nil
+}
+
+// ParseObfSettings - Parse the settings half of a rule, with a pipeline the
+// rule runs the pipeline's passes it enables (max runs all of them)
+func ParseObfSettings(settings string, defaults *ollvm.ObfArgs) (*ollvm.ObfArgs, error) {
+	switch settings {
+	case PolicyNone:
+		return nil, nil
+	case PolicyDefault:
+		return defaults, nil
+	case PolicyMax:
+		obfArgs := MaxObfArgs(defaults.AESSeed)
+		obfArgs.Pipeline = defaults.Pipeline
+		return obfArgs, nil
+	}
+
+	obfArgs := &ollvm.ObfArgs{AESSeed: defaults.AESSeed}
+	for _, pass := range strings.Split(settings, ",") {
+		passParts := strings.SplitN(strings.TrimSpace(pass), ":", 2)
+		count := 0
+		if len(passParts) == 2 {
+			var err error
+			count, err = strconv.Atoi(passParts[1])
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("Invalid count in '%s'", pass)
+			}
+		}
+		switch passParts[0] {
+		case ollvm.OptBCF:
+			obfArgs.BCF = true
+			obfArgs.BCFProb = defaults.BCFProb
+			if obfArgs.BCFProb < 1 {
+				obfArgs.BCFProb = ollvm.MaxProb
+			}
+			obfArgs.BCFLoop = pickCount(count, defaults.BCFLoop)
+		case ollvm.OptSub:
+			obfArgs.Sub = true
+			obfArgs.SubLoop = pickCount(count, defaults.SubLoop)
+		case ollvm.OptFlatten:
+			obfArgs.Flatten = true
+			obfArgs.FlattenSplit = pickCount(count, defaults.FlattenSplit)
+		case ollvm.OptStringEncryption:
+			obfArgs.StringEncryption = true
+		case ollvm.OptConstantEncryption:
+			obfArgs.ConstantEncryption = true
+		default:
+			return nil, fmt.Errorf("Unknown pass '%s' (valid passes: %s)", passParts[0], strings.Join(rulePasses, ", "))
+		}
+	}
+	if 0 < len(defaults.Pipeline) {
+		pipeline, err := rulePipeline(obfArgs, defaults.Pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid settings '%s': %s", settings, err)
+		}
+		obfArgs.Pipeline = pipeline
+	}
+	return obfArgs, nil
+}
+
+// rulePipeline - The pipeline's passes that obfArgs enables, in the
+// pipeline's order. A pipeline replaces the pass flags, so a pass the
+// pipeline doesn't run is an error rather than silently dropped.
+func rulePipeline(obfArgs *ollvm.ObfArgs, pipeline []*ollvm.Pass) ([]*ollvm.Pass, error) {
+	enabled := map[string]bool{
+		ollvm.OptBCF:     obfArgs.BCF,
+		ollvm.OptSub:     obfArgs.Sub,
+		ollvm.OptFlatten: obfArgs.Flatten,
+		ollvm.OptSplit:   obfArgs.Flatten,
+	}
+	missing := []string{}
+	if obfArgs.BCF && !ollvm.PipelineHas(pipeline, ollvm.OptBCF) {
+		missing = append(missing, ollvm.OptBCF)
+	}
+	if obfArgs.Sub && !ollvm.PipelineHas(pipeline, ollvm.OptSub) {
+		missing = append(missing, ollvm.OptSub)
+	}
+	if obfArgs.Flatten && !ollvm.PipelineHas(pipeline, ollvm.OptFlatten) && !ollvm.PipelineHas(pipeline, ollvm.OptSplit) {
+		missing = append(missing, ollvm.OptFlatten)
+	}
+	if 0 < len(missing) {
+		return nil, fmt.Errorf("%s not in the pipeline (%s)", strings.Join(missing, ", "), ollvm.PipelineString(pipeline))
+	}
+	passes := []*ollvm.Pass{}
+	for _, pass := range pipeline {
+		if enabled[pass.Name] {
+			passes = append(passes, pass)
+		}
+	}
+	return passes, nil
+}
+
+// MaxObfArgs - Every pass enabled at its maximum setting, string/constant
+// encryption are left alone since most toolchains don't support them
+func MaxObfArgs(seed string) *ollvm.ObfArgs {
+	return &ollvm.ObfArgs{
+		BCF:          true,
+		BCFProb:      ollvm.MaxProb,
+		BCFLoop:      ollvm.MaxBCFLoop,
+		Sub:          true,
+		SubLoop:      ollvm.MaxSubLoop,
+		Flatten:      true,
+		FlattenSplit: ollvm.MaxSplit,
+		AESSeed:      seed,
+	}
+}
+
+func pickCount(count int, fallback int) int {
+	if 0 < count {
+		return count
+	}
+	if 0 < fallback {
+		return fallback
+	}
+	return 1
+}
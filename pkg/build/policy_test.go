@@ -0,0 +1,212 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+func testDefaults(t *testing.T, pipeline string) *ollvm.ObfArgs {
+	defaults := &ollvm.ObfArgs{
+		BCF: true, BCFProb: 40, BCFLoop: 2,
+		Sub: true, SubLoop: 2,
+		Flatten: true, FlattenSplit: 3,
+		AESSeed: "denim",
+	}
+	if pipeline != "" {
+		var err error
+		defaults.Pipeline, err = ollvm.ParsePipeline(pipeline)
+		if err != nil {
+			t.Fatalf("ParsePipeline() error: %s", err)
+		}
+	}
+	return defaults
+}
+
+// TestRulePipeline - A rule runs the pipeline's passes it enables, in the
+// pipeline's order
+func TestRulePipeline(t *testing.T) {
+	tests := []struct {
+		settings string
+		want     string
+		err      string
+	}{
+		{settings: "sub", want: "sub:2"},
+		{settings: "bcf,sub", want: "sub:2,bcf:3"},
+		{settings: "fla", want: "fla:1,split:1"},
+		{settings: "strcry", want: ""},
+		{settings: PolicyDefault, want: "sub:2,fla:1,bcf:3,split:1"},
+		{settings: PolicyMax, want: "sub:2,fla:1,bcf:3,split:1"},
+	}
+	for _, test := range tests {
+		t.Run(test.settings, func(t *testing.T) {
+			defaults := testDefaults(t, "sub:2,fla,bcf:3,split")
+			obfArgs, err := ParseObfSettings(test.settings, defaults)
+			if err != nil {
+				t.Fatalf("ParseObfSettings() error: %s", err)
+			}
+			if got := ollvm.PipelineString(obfArgs.Pipeline); got != test.want {
+				t.Fatalf("Pipeline got: %s, want: %s", got, test.want)
+			}
+		})
+	}
+
+	defaults := testDefaults(t, "sub")
+	_, err := ParseObfSettings("fla,sub,bcf", defaults)
+	want := "Invalid settings 'fla,sub,bcf': bcf, fla not in the pipeline (sub:1)"
+	if err == nil || err.Error() != want {
+		t.Fatalf("ParseObfSettings() error: %v, want: %s", err, want)
+	}
+}
+
+// TestPolicyPrecedence - User rules in order, then the project's own
+// modules (@*), then everything (*) with --all
+func TestPolicyPrecedence(t *testing.T) {
+	defaults := testDefaults(t, "")
+	rules := []*Rule{}
+	for _, spec := range []string{"@mcrypto*=max", "@m*=none", "stdlib_*=sub", "*net*=fla:3"} {
+		rule, err := ParseRule(spec, defaults)
+		if err != nil {
+			t.Fatalf("ParseRule(%s) error: %s", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	tests := []struct {
+		cFile   string
+		allCode bool
+		want    string
+	}{
+		{cFile: "@mcrypto.nim.c", want: "max"},
+		{cFile: "@mmain.nim.c", want: "none"},
+		{cFile: "@pkg@mjson.nim.c", want: "default"},
+		{cFile: "stdlib_system.nim.c", want: "sub"},
+		{cFile: "stdlib_net.nim.c", want: "sub"},
+		{cFile: "@pkg@mnet.nim.c", want: "fla"},
+		{cFile: "nimnet.nim.c", want: "fla"},
+		{cFile: "other.nim.c", want: "none"},
+		{cFile: "other.nim.c", allCode: true, want: "default"},
+		{cFile: "@mmain.nim.c", allCode: true, want: "none"},
+	}
+	for _, test := range tests {
+		policy := NewPolicy(rules, defaults, test.allCode)
+		obfArgs := policy.Match(test.cFile)
+		got := "none"
+		switch {
+		case obfArgs == defaults:
+			got = "default"
+		case obfArgs == nil:
+		case obfArgs.BCFLoop == ollvm.MaxBCFLoop && obfArgs.SubLoop == ollvm.MaxSubLoop:
+			got = "max"
+		case obfArgs.Sub && !obfArgs.BCF && !obfArgs.Flatten:
+			got = "sub"
+		case obfArgs.Flatten && obfArgs.FlattenSplit == 3 && !obfArgs.BCF && !obfArgs.Sub:
+			got = "fla"
+		default:
+			got = fmt.Sprintf("%+v", obfArgs)
+		}
+		if got != test.want {
+			t.Errorf("Match(%s) with allCode=%v got: %s, want: %s", test.cFile, test.allCode, got, test.want)
+		}
+	}
+}
+
+// TestRuleMatches - Globs match the C file name with or without its
+// extensions, never the directory
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		cFile   string
+		want    bool
+	}{
+		{pattern: "@mcrypto", cFile: "/cache/@mcrypto.nim.c", want: true},
+		{pattern: "@mcrypto.nim", cFile: "/cache/@mcrypto.nim.c", want: true},
+		{pattern: "@mcrypto.nim.c", cFile: "/cache/@mcrypto.nim.c", want: true},
+		{pattern: "@m*crypto*", cFile: "@msrc@mcrypto@maes.nim.c", want: true},
+		{pattern: "@mcrypto", cFile: "@mcrypto2.nim.c", want: false},
+		{pattern: "cache", cFile: "/cache/@mcrypto.nim.c", want: false},
+		{pattern: "*/@mcrypto*", cFile: "/cache/@mcrypto.nim.c", want: false},
+		{pattern: "stdlib_?ystem", cFile: "stdlib_system.nim.c", want: true},
+		{pattern: "[a-c]*", cFile: "crypto.c", want: true},
+		{pattern: "crypto", cFile: "crypto.c", want: true},
+	}
+	for _, test := range tests {
+		rule := &Rule{Pattern: test.pattern}
+		if got := rule.Matches(test.cFile); got != test.want {
+			t.Errorf("Rule(%s).Matches(%s) got: %v, want: %v", test.pattern, test.cFile, got, test.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	defaults := testDefaults(t, "")
+	tests := []struct {
+		spec string
+		want *ollvm.ObfArgs
+	}{
+		{spec: "a=none", want: nil},
+		{spec: "a=default", want: defaults},
+		{spec: "a=max", want: MaxObfArgs(defaults.AESSeed)},
+		{spec: "a=bcf", want: &ollvm.ObfArgs{BCF: true, BCFProb: 40, BCFLoop: 2, AESSeed: "denim"}},
+		{spec: "a=bcf:4,sub:3", want: &ollvm.ObfArgs{BCF: true, BCFProb: 40, BCFLoop: 4, Sub: true, SubLoop: 3, AESSeed: "denim"}},
+		{spec: "a=fla:5, strcry,constenc", want: &ollvm.ObfArgs{
+			Flatten: true, FlattenSplit: 5,
+			StringEncryption: true, ConstantEncryption: true,
+			AESSeed: "denim",
+		}},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.spec, defaults)
+		if err != nil {
+			t.Errorf("ParseRule(%s) error: %s", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(rule.ObfArgs, test.want) {
+			t.Errorf("ParseRule(%s)\n got: %+v\nwant: %+v", test.spec, rule.ObfArgs, test.want)
+		}
+	}
+
+	// With no BCF probability to inherit, a bcf rule uses the maximum
+	rule, err := ParseRule("a=bcf", &ollvm.ObfArgs{})
+	if err != nil || rule.ObfArgs.BCFProb != ollvm.MaxProb || rule.ObfArgs.BCFLoop != 1 {
+		t.Errorf("ParseRule(a=bcf) without defaults got: %+v (%v)", rule, err)
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{spec: "@m*", err: "Invalid rule '@m*', expected <glob>=<settings>"},
+		{spec: "=max", err: "Invalid rule '=max', expected <glob>=<settings>"},
+		{spec: "@m*=", err: "Invalid rule '@m*=', expected <glob>=<settings>"},
+		{spec: "[=max", err: "Invalid rule glob '[': syntax error in pattern"},
+		{spec: "@m*=rot13", err: "Unknown pass 'rot13' (valid passes: bcf, sub, fla, strcry, constenc)"},
+		{spec: "@m*=fla:0", err: "Invalid count in 'fla:0'"},
+		{spec: "@m*=sub:x", err: "Invalid count in 'sub:x'"},
+		{spec: "@m*=MAX", err: "Unknown pass 'MAX' (valid passes: bcf, sub, fla, strcry, constenc)"},
+		{spec: "@m*=a=sub", err: "Unknown pass 'a=sub' (valid passes: bcf, sub, fla, strcry, constenc)"},
+		{spec: "@m*=bcf,", err: "Unknown pass '' (valid passes: bcf, sub, fla, strcry, constenc)"},
+	}
+	for _, test := range tests {
+		_, err := ParseRule(test.spec, testDefaults(t, ""))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("ParseRule(%s) error: %v, want: %s", test.spec, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+// Preset - A known-good obfuscation level, the pass options are fixed so
+// compile times and binary sizes are predictable. Rules are applied after
+// any user rules.
+type Preset struct {
+	Name    string
+	ObfArgs *ollvm.ObfArgs
+	AllCode bool
+	Rules   []string
+}
+
+var (
+	// Presets - Weakest to strongest
+	Presets = []*Preset{
+		{
+			Name:    "light",
+			ObfArgs: &ollvm.ObfArgs{Sub: true, SubLoop: 1},
+		},
+		{
+			Name: "balanced",
+			ObfArgs: &ollvm.ObfArgs{
+				BCF: true, BCFProb: 30, BCFLoop: 1,
+				Sub: true, SubLoop: 1,
+				Flatten: true, FlattenSplit: 1,
+			},
+		},
+		{
+			Name: "heavy",
+			ObfArgs: &ollvm.ObfArgs{
+				BCF: true, BCFProb: 60, BCFLoop: 2,
+				Sub: true, SubLoop: 2,
+				Flatten: true, FlattenSplit: 3,
+			},
+			Rules: []string{"stdlib_*=sub"},
+		},
+		{
+			Name: "paranoid",
+			ObfArgs: &ollvm.ObfArgs{
+				BCF: true, BCFProb: 100, BCFLoop: 3,
+				Sub: true, SubLoop: 3,
+				Flatten: true, FlattenSplit: 3,
+			},
+			AllCode: true,
+			Rules:   []string{"stdlib_*=fla,sub"},
+		},
+	}
+)
+
+// PresetNames - Names of the presets, weakest to strongest
+func PresetNames() []string {
+	names := []string{}
+	for _, preset := range Presets {
+		names = append(names, preset.Name)
+	}
+	return names
+}
+
+// GetPreset - Look up a preset by name
+func GetPreset(name string) (*Preset, error) {
+	for _, preset := range Presets {
+		if preset.Name == name {
+			return preset, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown preset '%s' (presets: %s)", name, strings.Join(PresetNames(), ", "))
+}
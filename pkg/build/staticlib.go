@@ -0,0 +1,110 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/logger"
+	"github.com/moloch--/denim/pkg/nim"
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+const (
+	// AppStaticLib - Static library (.a/.lib) of the obfuscated objects
+	AppStaticLib = "staticlib"
+
+	nimBaseHeader = "nimbase.h"
+)
+
+// headerName - The C header nim generates for a static library's exported
+// procs, named after the first nim file
+func headerName(build *Build) string {
+	base := filepath.Base(build.NimFiles[0])
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ".h"
+}
+
+// archive - Archive the compiled objects instead of linking them, and put
+// the generated header (and nimbase.h which it includes) next to the archive
+func archive(build *Build, clang *ollvm.Clang, nimCache string, nimProject *nim.Project) error {
+	objs := []string{}
+	for _, link := range nimProject.Link {
+		if isResource(link) {
+			continue
+		}
+		objs = append(objs, link)
+	}
+	if _, err := os.Stat(nimProject.OutputFile); err == nil {
+		os.Remove(nimProject.OutputFile) // Don't add to a stale archive
+	}
+	if build.EmitDir != "" {
+		err := emitLinkCommand(build, "ar", append([]string{"rcs", nimProject.OutputFile}, objs...))
+		if err != nil {
+			return err
+		}
+	}
+	stdout, stderr, err := clang.Archive(nimCache, nimProject.OutputFile, objs)
+	logger.Output(stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("Failed to archive objects: %s\n%s", err, stderr)
+	}
+
+	outputDir := filepath.Dir(nimProject.OutputFile)
+	header := headerName(build)
+	headerPath := ""
+	workDir, _ := os.Getwd()
+	for _, dir := range []string{nimCache, filepath.Dir(build.NimFiles[0]), workDir} {
+		if _, err := os.Stat(filepath.Join(dir, header)); err == nil {
+			headerPath = filepath.Join(dir, header)
+			break
+		}
+	}
+	if headerPath == "" {
+		return fmt.Errorf("Nim did not generate a header (%s)", header)
+	}
+	if filepath.Dir(headerPath) != outputDir {
+		err = copyFile(headerPath, filepath.Join(outputDir, header))
+		if err != nil {
+			return err
+		}
+	}
+	nimBase := findNimBase(nimProject)
+	if nimBase == "" {
+		return fmt.Errorf("Could not find %s", nimBaseHeader)
+	}
+	return copyFile(nimBase, filepath.Join(outputDir, nimBaseHeader))
+}
+
+// findNimBase - nimbase.h is in one of the include dirs nim passes to clang
+func findNimBase(nimProject *nim.Project) string {
+	for _, step := range nimProject.Compile {
+		if len(step) != 2 {
+			continue
+		}
+		for _, arg := range strings.Fields(step[1]) {
+			if !strings.HasPrefix(arg, "-I") {
+				continue
+			}
+			includeDir := strings.Trim(strings.TrimPrefix(arg, "-I"), "\"'")
+			nimBase := filepath.Join(includeDir, nimBaseHeader)
+			if _, err := os.Stat(nimBase); err == nil {
+				return nimBase
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/moloch--/denim/pkg/assets"
+)
+
+// Target - A compilation target (e.g. windows/amd64)
+type Target struct {
+	Name   string
+	NimOS  string
+	NimCPU string
+	Triple string
+
+	// Sysroot - Headers/libs for the target, empty lets clang decide
+	Sysroot   string
+	LinkFlags []string
+}
+
+var (
+	// Nim's runtime pulls in libdl/libm/librt on Linux, the mingw-w64
+	// runtime is handled by clang's driver but ld stamps PE files with the
+	// link time, which would make builds from the same seed differ
+	linuxLinkFlags   = []string{"-lm", "-lrt", "-ldl", "-lpthread"}
+	windowsLinkFlags = []string{"-Wl,--no-insert-timestamp"}
+
+	targets = map[string]*Target{
+		"windows/amd64": {
+			NimOS:     "windows",
+			NimCPU:    "amd64",
+			Triple:    "x86_64-w64-mingw32",
+			LinkFlags: windowsLinkFlags,
+		},
+		"windows/386": {
+			NimOS:     "windows",
+			NimCPU:    "i386",
+			Triple:    "i686-w64-mingw32",
+			LinkFlags: windowsLinkFlags,
+		},
+		"linux/amd64": {
+			NimOS:     "linux",
+			NimCPU:    "amd64",
+			Triple:    "x86_64-linux-gnu",
+			LinkFlags: linuxLinkFlags,
+		},
+		"linux/arm64": {
+			NimOS:     "linux",
+			NimCPU:    "arm64",
+			Triple:    "aarch64-linux-gnu",
+			LinkFlags: linuxLinkFlags,
+		},
+	}
+)
+
+// HostTarget - Name of the target denim is running on
+func HostTarget() string {
+	return fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// TargetNames - Sorted list of supported targets
+func TargetNames() []string {
+	names := []string{}
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetTarget - Get a target by name, an empty name is the host, sysroot may be
+// empty in which case we'll look in the usual places for one
+func GetTarget(name string, sysroot string) (*Target, error) {
+	if name == "" {
+		name = HostTarget()
+	}
+	target, ok := targets[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported target '%s' (valid targets: %v)", name, TargetNames())
+	}
+	resolved := &Target{
+		Name:      name,
+		NimOS:     target.NimOS,
+		NimCPU:    target.NimCPU,
+		Triple:    target.Triple,
+		Sysroot:   sysroot,
+		LinkFlags: target.LinkFlags,
+	}
+	if resolved.Sysroot == "" && !resolved.IsHost() {
+		resolved.Sysroot = findSysroot(resolved)
+	}
+	return resolved, nil
+}
+
+// IsHost - Is the target the same as the host, we let the toolchain use
+// its defaults when it is
+func (t *Target) IsHost() bool {
+	return t.Name == HostTarget()
+}
+
+// findSysroot - The mingw-w64 install from 'denim setup' or the location
+// distro mingw-w64 packages install to, clang finds linux cross toolchains
+// on its own so we leave those alone
+func findSysroot(target *Target) string {
+	if target.NimOS != "windows" {
+		return ""
+	}
+	candidates := []string{}
+	if runtime.GOOS == "windows" {
+		if target.NimCPU == "amd64" {
+			// A broken mingw64 install is reported when clang runs
+			if mingwDir, err := assets.GetMingwDir(); err == nil {
+				candidates = append(candidates, mingwDir)
+			}
+		} else {
+			candidates = append(candidates, filepath.Join(assets.GetRootDir(), "mingw32"))
+		}
+	}
+	candidates = append(candidates, filepath.Join("/usr", target.Triple))
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
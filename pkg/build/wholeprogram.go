@@ -0,0 +1,112 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/logger"
+	"github.com/moloch--/denim/pkg/nim"
+	"github.com/moloch--/denim/pkg/ollvm"
+)
+
+// bitcodeJobs - Compile each C file to a bitcode module instead of an
+// object, nothing is obfuscated until the modules are merged
+func bitcodeJobs(jobs []*compileJob) []*compileJob {
+	bcJobs := []*compileJob{}
+	for _, job := range jobs {
+		object := objectPath("", job.Args)
+		bitcode := strings.TrimSuffix(object, filepath.Ext(object)) + ".bc"
+		bcJobs = append(bcJobs, &compileJob{
+			CFile:   job.CFile,
+			CSource: job.CSource,
+			Args:    ollvm.BitcodeArgs(job.Args, bitcode),
+		})
+	}
+	return bcJobs
+}
+
+// compileWholeProgram - Merge the bitcode of every C file with llvm-link
+// and obfuscate the merged module once, so passes (and the optimizer) can
+// work across nim modules. The link step gets one object instead of one
+// per C file.
+func compileWholeProgram(build *Build, clang *ollvm.Clang, nimCache string, nimProject *nim.Project, jobs []*compileJob, obfArgs *ollvm.ObfArgs) error {
+	modules := []string{}
+	for _, job := range jobs {
+		modules = append(modules, objectPath(nimCache, job.Args))
+	}
+	name := strings.TrimSuffix(build.Name, filepath.Ext(build.Name))
+	merged := filepath.Join(nimCache, name+".merged.bc")
+	stdout, stderr, err := clang.LinkBitcode(nimCache, merged, modules)
+	logger.Output(stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("Failed to link bitcode: %s\n%s", err, stderr)
+	}
+
+	object := filepath.Join(nimCache, name+".merged.o")
+	args := append(codegenFlags(jobs[0].Args), "-c", merged, "-o", object)
+	stdout, stderr, err = clang.ObfCompile(nimCache, args, obfArgs)
+	logger.Output(stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("Failed to compile merged module: %s\n%s", err, stderr)
+	}
+	nimProject.Link = replaceObjects(nimCache, nimProject.Link, jobs, object)
+	return nil
+}
+
+// codegenFlags - Flags from a C file's compile command that still matter
+// when generating code from bitcode (optimization, codegen, and debug info)
+func codegenFlags(args []string) []string {
+	flags := []string{}
+	for _, arg := range args {
+		for _, prefix := range []string{"-O", "-f", "-m", "-g"} {
+			if strings.HasPrefix(arg, prefix) {
+				flags = append(flags, arg)
+				break
+			}
+		}
+	}
+	return flags
+}
+
+// replaceObjects - Swap the per-file objects nim expects to link with the
+// merged object, keeping the position of the first one
+func replaceObjects(nimCache string, link []string, jobs []*compileJob, object string) []string {
+	objects := map[string]bool{}
+	for _, job := range jobs {
+		objects[strings.TrimSuffix(objectPath(nimCache, job.Args), ".bc")] = true
+	}
+	replaced := []string{}
+	added := false
+	for _, entry := range link {
+		path := strings.Trim(entry, "\"'")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(nimCache, path)
+		}
+		if !objects[strings.TrimSuffix(path, filepath.Ext(path))] {
+			replaced = append(replaced, entry)
+			continue
+		}
+		if !added {
+			replaced = append(replaced, object)
+			added = true
+		}
+	}
+	if !added {
+		replaced = append([]string{object}, replaced...)
+	}
+	return replaced
+}
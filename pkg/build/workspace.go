@@ -0,0 +1,77 @@
+package build
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/moloch--/denim/pkg/assets"
+)
+
+// Workspace - The nimcache a single build uses
+type Workspace struct {
+	Dir  string
+	lock *assets.FileLock
+}
+
+// NewWorkspace - Builds of a project reuse a stable workspace path, which
+// keeps paths in the output the same from build to build. If another build
+// of the same project holds the stable workspace we use a unique one.
+func NewWorkspace(build *Build) (*Workspace, error) {
+	nimCacheRoot := assets.GetNimCacheRoot()
+	project, err := filepath.Abs(build.NimFiles[0])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s", project, build.Target.Name, build.App)))
+	stableDir := filepath.Join(nimCacheRoot, fmt.Sprintf("%s-%x", build.Name, digest[:6]))
+
+	lock, locked, err := assets.TryLock(stableDir + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		err = os.RemoveAll(stableDir)
+		if err == nil {
+			err = os.MkdirAll(stableDir, 0700)
+		}
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		return &Workspace{Dir: stableDir, lock: lock}, nil
+	}
+
+	uniqueDir, err := ioutil.TempDir(nimCacheRoot, build.Name+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{Dir: uniqueDir}, nil
+}
+
+// Close - Release the workspace, deleting it unless keep is set
+func (w *Workspace) Close(keep bool) error {
+	var err error
+	if !keep {
+		err = os.RemoveAll(w.Dir)
+	}
+	if w.lock != nil {
+		w.lock.Unlock()
+	}
+	return err
+}
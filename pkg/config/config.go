@@ -0,0 +1,219 @@
+package config
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// ProjectConfigFile - Project configuration in the project directory
+	ProjectConfigFile = "denim.toml"
+)
+
+// Obfuscation - ObfArgs defaults, named after the compile flags
+type Obfuscation struct {
+	Preset         *string  `toml:"preset"`
+	BCF            *bool    `toml:"bcf"`
+	BCFLoop        *int     `toml:"bcf-loop"`
+	BCFProbability *int     `toml:"bcf-probability"`
+	Sub            *bool    `toml:"sub"`
+	SubLoop        *int     `toml:"sub-loop"`
+	Flatten        *bool    `toml:"flatten"`
+	FlattenSplit   *int     `toml:"flatten-split"`
+	Seed           *string  `toml:"seed"`
+	StrCry         *bool    `toml:"strcry"`
+	ConstEnc       *bool    `toml:"constenc"`
+	Pipeline       *string  `toml:"pipeline"`
+	WholeProgram   *bool    `toml:"whole-program"`
+	All            *bool    `toml:"all"`
+	Rules          []string `toml:"rules"`
+}
+
+// Settings - Compile settings, unset (nil) values are left to the flags
+type Settings struct {
+	Files     []string `toml:"files"`
+	Output    *string  `toml:"output"`
+	Toolchain []string `toml:"toolchain"`
+	Target    *string  `toml:"target"`
+	App       *string  `toml:"app"`
+	Defines   []string `toml:"defines"`
+	Resources []string `toml:"resources"`
+	CFlags    []string `toml:"cflags"`
+	LDFlags   []string `toml:"ldflags"`
+
+	Obfuscation Obfuscation `toml:"obfuscation"`
+}
+
+// Config - A project's denim.toml, the top level settings apply to every
+// build and a profile's settings replace them
+type Config struct {
+	Settings
+	Profiles map[string]*Settings `toml:"profiles"`
+
+	// Dir - Relative paths are relative to the config file
+	Dir string `toml:"-"`
+}
+
+// Load - Parse a config file, unknown keys are an error since a typo would
+// otherwise silently change the build
+func Load(path string) (*Config, error) {
+	config := &Config{}
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", path, err)
+	}
+	if undecoded := meta.Undecoded(); 0 < len(undecoded) {
+		keys := []string{}
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return nil, fmt.Errorf("Invalid %s: unknown settings %s", path, strings.Join(keys, ", "))
+	}
+	config.Dir, err = filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ProfileNames - The config's profiles in a stable order
+func (c *Config) ProfileNames() []string {
+	names := []string{}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile - The top level settings with a profile's settings applied, an
+// empty name is just the top level settings
+func (c *Config) Profile(name string) (*Settings, error) {
+	settings := c.Settings
+	if name != "" {
+		profile, ok := c.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown profile '%s' (profiles: %s)", name, strings.Join(c.ProfileNames(), ", "))
+		}
+		settings.merge(profile)
+	}
+	settings.Files = c.paths(settings.Files)
+	settings.Resources = c.paths(settings.Resources)
+	if settings.Output != nil {
+		output := c.paths([]string{*settings.Output})[0]
+		settings.Output = &output
+	}
+	return &settings, nil
+}
+
+// merge - Replace settings with those set in profile
+func (s *Settings) merge(profile *Settings) {
+	if profile.Files != nil {
+		s.Files = profile.Files
+	}
+	if profile.Output != nil {
+		s.Output = profile.Output
+	}
+	if profile.Toolchain != nil {
+		s.Toolchain = profile.Toolchain
+	}
+	if profile.Target != nil {
+		s.Target = profile.Target
+	}
+	if profile.App != nil {
+		s.App = profile.App
+	}
+	if profile.Defines != nil {
+		s.Defines = profile.Defines
+	}
+	if profile.Resources != nil {
+		s.Resources = profile.Resources
+	}
+	if profile.CFlags != nil {
+		s.CFlags = profile.CFlags
+	}
+	if profile.LDFlags != nil {
+		s.LDFlags = profile.LDFlags
+	}
+	s.Obfuscation.merge(&profile.Obfuscation)
+}
+
+func (o *Obfuscation) merge(profile *Obfuscation) {
+	if profile.Preset != nil {
+		o.Preset = profile.Preset
+	}
+	if profile.BCF != nil {
+		o.BCF = profile.BCF
+	}
+	if profile.BCFLoop != nil {
+		o.BCFLoop = profile.BCFLoop
+	}
+	if profile.BCFProbability != nil {
+		o.BCFProbability = profile.BCFProbability
+	}
+	if profile.Sub != nil {
+		o.Sub = profile.Sub
+	}
+	if profile.SubLoop != nil {
+		o.SubLoop = profile.SubLoop
+	}
+	if profile.Flatten != nil {
+		o.Flatten = profile.Flatten
+	}
+	if profile.FlattenSplit != nil {
+		o.FlattenSplit = profile.FlattenSplit
+	}
+	if profile.Seed != nil {
+		o.Seed = profile.Seed
+	}
+	if profile.StrCry != nil {
+		o.StrCry = profile.StrCry
+	}
+	if profile.ConstEnc != nil {
+		o.ConstEnc = profile.ConstEnc
+	}
+	if profile.Pipeline != nil {
+		o.Pipeline = profile.Pipeline
+	}
+	if profile.WholeProgram != nil {
+		o.WholeProgram = profile.WholeProgram
+	}
+	if profile.All != nil {
+		o.All = profile.All
+	}
+	if profile.Rules != nil {
+		o.Rules = profile.Rules
+	}
+}
+
+// paths - Make relative paths relative to the config file
+func (c *Config) paths(paths []string) []string {
+	if paths == nil {
+		return nil
+	}
+	resolved := []string{}
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(c.Dir, path)
+		}
+		resolved = append(resolved, path)
+	}
+	return resolved
+}
@@ -0,0 +1,148 @@
+package config
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fill - Set every setting (recursing into nested structs) to a value
+// derived from tag, so a field merge forgets is caught without listing the
+// fields here
+func fill(t *testing.T, value reflect.Value, tag string) {
+	for index := 0; index < value.NumField(); index++ {
+		field := value.Field(index)
+		name := fmt.Sprintf("%s-%s", tag, value.Type().Field(index).Name)
+		switch field.Kind() {
+		case reflect.Struct:
+			fill(t, field, tag)
+		case reflect.Slice:
+			field.Set(reflect.ValueOf([]string{name}))
+		case reflect.Ptr:
+			switch field.Type().Elem().Kind() {
+			case reflect.String:
+				field.Set(reflect.ValueOf(&name))
+			case reflect.Int:
+				number := len(name)
+				field.Set(reflect.ValueOf(&number))
+			case reflect.Bool:
+				enabled := tag == "profile"
+				field.Set(reflect.ValueOf(&enabled))
+			default:
+				t.Fatalf("fill() doesn't support %s (%s)", name, field.Type())
+			}
+		default:
+			t.Fatalf("fill() doesn't support %s (%s)", name, field.Type())
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	config := &Config{Dir: "/project", Profiles: map[string]*Settings{}}
+	fill(t, reflect.ValueOf(&config.Settings).Elem(), "top")
+	profile := &Settings{}
+	fill(t, reflect.ValueOf(profile).Elem(), "profile")
+	config.Profiles["release"] = profile
+
+	settings, err := config.Profile("release")
+	if err != nil {
+		t.Fatalf("Profile() error: %s", err)
+	}
+	want := *profile
+	want.Files = []string{filepath.Join("/project", "profile-Files")}
+	want.Resources = []string{filepath.Join("/project", "profile-Resources")}
+	output := filepath.Join("/project", "profile-Output")
+	want.Output = &output
+	if !reflect.DeepEqual(*settings, want) {
+		t.Fatalf("Profile()\n got: %+v\nwant: %+v", *settings, want)
+	}
+
+	// The profile must not change the top level settings
+	top, err := config.Profile("")
+	if err != nil {
+		t.Fatalf("Profile() error: %s", err)
+	}
+	if *top.Target != "top-Target" || *top.Obfuscation.Seed != "top-Seed" || top.Files[0] != filepath.Join("/project", "top-Files") {
+		t.Fatalf("Profile(\"\") got profile settings: %+v", *top)
+	}
+
+	if _, err := config.Profile("debug"); err == nil || err.Error() != "Unknown profile 'debug' (profiles: release)" {
+		t.Fatalf("Profile(debug) error: %v", err)
+	}
+}
+
+// TestProfileUnset - Settings a profile doesn't set keep their top level
+// values, absolute paths are kept as is
+func TestProfileUnset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "denim-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, ProjectConfigFile)
+	err = ioutil.WriteFile(configFile, []byte(`
+files = ["src/main.nim", "/abs/other.nim"]
+target = "windows/amd64"
+defines = ["ssl"]
+
+[obfuscation]
+bcf-loop = 2
+rules = ["@mcrypto*=max"]
+
+[profiles.dev]
+defines = []
+
+[profiles.dev.obfuscation]
+bcf = false
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Load() error: %s", err)
+	}
+	settings, err := config.Profile("dev")
+	if err != nil {
+		t.Fatalf("Profile() error: %s", err)
+	}
+	wantFiles := []string{filepath.Join(config.Dir, "src", "main.nim"), "/abs/other.nim"}
+	if !reflect.DeepEqual(settings.Files, wantFiles) {
+		t.Fatalf("Files got: %v, want: %v", settings.Files, wantFiles)
+	}
+	if *settings.Target != "windows/amd64" || *settings.Obfuscation.BCFLoop != 2 || settings.Obfuscation.Rules[0] != "@mcrypto*=max" {
+		t.Fatalf("Profile() lost top level settings: %+v", settings)
+	}
+	if len(settings.Defines) != 0 || *settings.Obfuscation.BCF {
+		t.Fatalf("Profile() didn't apply the profile: %+v", settings)
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "denim-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, ProjectConfigFile)
+	ioutil.WriteFile(configFile, []byte("[obfuscation]\nbcf-loops = 2\n"), 0600)
+	if _, err := Load(configFile); err == nil {
+		t.Fatalf("Load() should reject unknown settings")
+	}
+}
@@ -0,0 +1,361 @@
+package logger
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level - Severity of a log message
+type Level int
+
+const (
+	// DebugLevel - Commands, tool output, and other details
+	DebugLevel Level = iota
+	// InfoLevel - Progress
+	InfoLevel
+	// WarnLevel - Something the user should know about
+	WarnLevel
+	// ErrorLevel - Something failed
+	ErrorLevel
+
+	// MaxLogFiles - Build logs kept in the logs directory
+	MaxLogFiles = 50
+
+	normal = "\033[0m"
+	red    = "\033[31m"
+	green  = "\033[32m"
+	purple = "\033[35m"
+	cyan   = "\033[36m"
+	bold   = "\033[1m"
+)
+
+var (
+	levelNames = map[Level]string{
+		DebugLevel: "debug",
+		InfoLevel:  "info",
+		WarnLevel:  "warn",
+		ErrorLevel: "error",
+	}
+
+	mutex   sync.Mutex
+	level             = InfoLevel
+	color             = true
+	console io.Writer = os.Stdout
+	handler Handler
+	logFile *os.File
+)
+
+// Handler - Displays messages instead of the console (e.g. as JSON events),
+// it's called with every message regardless of the level
+type Handler func(lvl Level, success bool, message string)
+
+// String - Name of the level as accepted by ParseLevel
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel - Parse a level name (debug, info, warn, error)
+func ParseLevel(name string) (Level, error) {
+	for lvl, lvlName := range levelNames {
+		if strings.EqualFold(name, lvlName) {
+			return lvl, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Invalid log level '%s' (valid levels: %s)", name, strings.Join(LevelNames(), ", "))
+}
+
+// LevelNames - Names of all levels, least severe first
+func LevelNames() []string {
+	names := []string{}
+	for lvl := DebugLevel; lvl <= ErrorLevel; lvl++ {
+		names = append(names, lvl.String())
+	}
+	return names
+}
+
+// SetLevel - Messages below this level are not displayed, the build log
+// records everything regardless
+func SetLevel(lvl Level) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	level = lvl
+}
+
+// Enabled - Are messages of this level displayed
+func Enabled(lvl Level) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return level <= lvl
+}
+
+// SetColor - Enable/disable ANSI colors on the console
+func SetColor(enabled bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	color = enabled
+}
+
+// SetConsole - Where displayed messages are written
+func SetConsole(writer io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	console = writer
+}
+
+// SetHandler - Display messages with handler instead of the console, nil
+// restores the console
+func SetHandler(h Handler) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	handler = h
+}
+
+// IsTerminal - Is the file a terminal (i.e. not a pipe or a regular file)
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Prefix - Console prefix for a message of the level, success is an info
+// level message with its own prefix
+func Prefix(lvl Level, success bool) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return prefix(lvl, success)
+}
+
+func prefix(lvl Level, success bool) string {
+	var tag, ansi string
+	switch {
+	case success:
+		tag, ansi = "[$] ", green
+	case lvl == DebugLevel:
+		tag, ansi = "[-] ", purple
+	case lvl == InfoLevel:
+		tag, ansi = "[*] ", cyan
+	default:
+		tag, ansi = "[!] ", red
+	}
+	if !color {
+		return tag
+	}
+	return bold + ansi + tag + normal
+}
+
+// OpenFile - Start a new build log in dir, the log records every message and
+// command (regardless of level) until CloseFile. Old logs are pruned so
+// only the most recent MaxLogFiles are kept.
+func OpenFile(dir string, name string) (string, error) {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>| `, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	fileName := fmt.Sprintf("%s-%s.log", time.Now().Format("20060102-150405.000"), name)
+	logPath := filepath.Join(dir, fileName)
+	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	mutex.Lock()
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	mutex.Unlock()
+	pruneLogs(dir, MaxLogFiles)
+	return logPath, nil
+}
+
+// CloseFile - Stop writing to the build log
+func CloseFile() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
+
+func pruneLogs(dir string, keep int) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	logs := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".log") {
+			logs = append(logs, entry.Name())
+		}
+	}
+	sort.Strings(logs) // Names start with a timestamp
+	for index := 0; index < len(logs)-keep; index++ {
+		os.Remove(filepath.Join(dir, logs[index]))
+	}
+}
+
+// Debugf - Log a debug message
+func Debugf(format string, args ...interface{}) {
+	Log(DebugLevel, false, format, args...)
+}
+
+// Infof - Log an info message
+func Infof(format string, args ...interface{}) {
+	Log(InfoLevel, false, format, args...)
+}
+
+// Successf - Log an info message about something that went well
+func Successf(format string, args ...interface{}) {
+	Log(InfoLevel, true, format, args...)
+}
+
+// Warnf - Log a warning
+func Warnf(format string, args ...interface{}) {
+	Log(WarnLevel, false, format, args...)
+}
+
+// Errorf - Log an error
+func Errorf(format string, args ...interface{}) {
+	Log(ErrorLevel, false, format, args...)
+}
+
+// Log - Display the message if the level is enabled (or pass it to the
+// handler), and record it in the build log
+func Log(lvl Level, success bool, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	mutex.Lock()
+	record(lvl, message)
+	h := handler
+	if h == nil && level <= lvl {
+		fmt.Fprint(console, prefix(lvl, success)+message)
+	}
+	mutex.Unlock()
+	if h != nil {
+		h(lvl, success, message) // Unlocked, the handler may call Enabled
+	}
+}
+
+// Record - Only record the message in the build log
+func Record(lvl Level, format string, args ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	record(lvl, fmt.Sprintf(format, args...))
+}
+
+func record(lvl Level, message string) {
+	if logFile == nil {
+		return
+	}
+	timestamp := time.Now().Format("2006-01-02T15:04:05.000")
+	for _, line := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+		fmt.Fprintf(logFile, "%s %-5s %s\n", timestamp, strings.ToUpper(lvl.String()), line)
+	}
+}
+
+// Output - Display tool output at debug level, the output is not recorded
+// since Command already has
+func Output(stdout []byte, stderr []byte) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if DebugLevel < level {
+		return
+	}
+	if 0 < len(stdout) {
+		fmt.Fprint(console, string(stdout))
+	}
+	if 0 < len(stderr) {
+		fmt.Fprint(console, string(stderr))
+	}
+}
+
+// Command - Record an executed command in the build log: its argv,
+// environment, exit code, and output
+func Command(wd string, env []string, argv []string, stdout []byte, stderr []byte, err error, duration time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if logFile == nil {
+		return
+	}
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+	lines := []string{fmt.Sprintf("exec: %s", strings.Join(quoteArgs(argv), " "))}
+	lines = append(lines, fmt.Sprintf("  dir: %s", wd))
+	if sameEnv(env, os.Environ()) {
+		lines = append(lines, "  env: (inherited)")
+	} else {
+		for _, variable := range env {
+			lines = append(lines, fmt.Sprintf("  env: %s", variable))
+		}
+	}
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("  error: %s", err))
+	}
+	lines = append(lines, fmt.Sprintf("  exit code: %d (%s)", exitCode, duration.Round(time.Millisecond)))
+	lines = append(lines, indentOutput("stdout", stdout)...)
+	lines = append(lines, indentOutput("stderr", stderr)...)
+	record(DebugLevel, strings.Join(lines, "\n"))
+}
+
+func sameEnv(env []string, environ []string) bool {
+	if len(env) != len(environ) {
+		return false
+	}
+	for index := range env {
+		if env[index] != environ[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func indentOutput(name string, data []byte) []string {
+	output := strings.TrimRight(string(data), "\n")
+	if output == "" {
+		return []string{fmt.Sprintf("  %s: (empty)", name)}
+	}
+	lines := []string{fmt.Sprintf("  %s:", name)}
+	for _, line := range strings.Split(output, "\n") {
+		lines = append(lines, "    "+line)
+	}
+	return lines
+}
+
+func quoteArgs(argv []string) []string {
+	quoted := []string{}
+	for _, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		quoted = append(quoted, arg)
+	}
+	return quoted
+}
@@ -0,0 +1,89 @@
+## Denim function level obfuscation
+##
+## Obfuscate only the procs that matter, or keep hot procs out of an
+## obfuscated module. When any proc uses `obf` denim only obfuscates
+## annotated procs.
+##
+## .. code-block:: nim
+##   import denim
+##
+##   proc decrypt(data: string): string {.obf: "fla,bcf".} =
+##     ...
+##
+##   proc checksum(data: string): int {.noobf.} =
+##     ...
+##
+## The annotations are added with `codegenDecl`, which replaces the whole C
+## header of the proc, so `obf`/`noobf` rebuild Nim's own header (visibility
+## and calling convention). They can't be combined with `codegenDecl` or
+## used on closures, and nested procs are treated as `nimcall`.
+
+import std/[macros, strutils]
+
+const
+  passes = ["bcf", "sub", "fla"]
+
+  # Calling convention pragmas and their nimbase.h macros
+  callConvs = [
+    ("nimcall", "N_NIMCALL"), ("cdecl", "N_CDECL"), ("stdcall", "N_STDCALL"),
+    ("fastcall", "N_FASTCALL"), ("safecall", "N_SAFECALL"), ("syscall", "N_SYSCALL"),
+    ("thiscall", "N_THISCALL"), ("noconv", "N_NOCONV"), ("inline", "N_INLINE"),
+    ("noinline", "N_NOINLINE"),
+  ]
+
+proc pragmaName(pragma: NimNode): string =
+  case pragma.kind
+  of nnkIdent, nnkSym:
+    result = pragma.strVal
+  of nnkExprColonExpr, nnkCall, nnkCallStrLit:
+    result = pragmaName(pragma[0])
+  else:
+    result = ""
+
+proc annotate(procDef: NimNode, annotations: openArray[string]): NimNode =
+  ## The header Nim would generate (see genProcHeader in cgen) with the
+  ## annotations added
+  if procDef.kind notin {nnkProcDef, nnkFuncDef, nnkMethodDef, nnkConverterDef}:
+    error("obf/noobf can only be used on procs", procDef)
+  var
+    callConv = "N_NIMCALL"
+    exportLib = false
+  for pragma in procDef.pragma:
+    let name = pragmaName(pragma)
+    case name
+    of "codegenDecl":
+      error("obf/noobf replace the proc's codegenDecl, remove one of them", pragma)
+    of "closure":
+      error("obf/noobf can't be used on closures", pragma)
+    of "dynlib":
+      exportLib = true
+    else:
+      for (conv, convMacro) in callConvs:
+        if name == conv:
+          callConv = convMacro
+  var decl =
+    if exportLib: "N_LIB_EXPORT "
+    elif callConv == "N_INLINE": "static "
+    else: "N_LIB_PRIVATE "
+  for annotation in annotations:
+    decl.add "__attribute__((annotate(\"" & annotation & "\"))) "
+  result = newColonExpr(ident"codegenDecl", newLit(decl & callConv & "($#, $#)$#"))
+
+macro obf*(passList: static[string], procDef: untyped): untyped =
+  ## Obfuscate a proc with a comma separated list of passes (bcf, sub, fla)
+  var annotations: seq[string]
+  for pass in passList.split(','):
+    let pass = pass.strip
+    if pass notin passes:
+      error("unknown obfuscation pass '" & pass & "', expected one of " & $passes, procDef)
+    annotations.add pass
+  result = procDef
+  result.addPragma(annotate(procDef, annotations))
+
+macro noobf*(procDef: untyped): untyped =
+  ## Never obfuscate a proc
+  var annotations: seq[string]
+  for pass in passes:
+    annotations.add "no" & pass
+  result = procDef
+  result.addPragma(annotate(procDef, annotations))
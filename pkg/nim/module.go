@@ -0,0 +1,54 @@
+package nim
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	// Embed the denim nim module
+	_ "embed"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// ModuleName - File name of the nim module providing denim's pragmas
+	ModuleName = "denim.nim"
+)
+
+//go:embed denim.nim
+var module []byte
+
+// InstallModule - Write the denim nim module to dir, so projects can
+// 'import denim' when dir is on nim's --path. Concurrent builds may be
+// reading it, so it's only replaced if it changed and then atomically.
+func InstallModule(dir string) error {
+	modulePath := filepath.Join(dir, ModuleName)
+	if installed, err := ioutil.ReadFile(modulePath); err == nil && bytes.Equal(installed, module) {
+		return nil
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(module)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), modulePath)
+}
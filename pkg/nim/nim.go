@@ -15,18 +15,37 @@ package nim
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/moloch--/denim/pkg/logger"
+)
+
+var (
+	versionRegex = regexp.MustCompile(`Nim Compiler Version (\d+\.\d+\.\d+)`)
 )
 
 // Project - Nim Project JSON
 type Project struct {
-	OutputFile string     `json:"outputFile"`
-	Compile    [][]string `json:"compile"`
-	Link       []string   `json:"link"`
-	LinkCmd    string     `json:"linkcmd"`
-	ExtraCmds  []string   `json:"extraCmds"`
-	StdinInput bool       `json:"stdinInput"`
+	OutputFile   string     `json:"outputFile"`
+	Compile      [][]string `json:"compile"`
+	Link         []string   `json:"link"`
+	LinkCmd      string     `json:"linkcmd"`
+	ExtraCmds    []string   `json:"extraCmds"`
+	StdinInput   bool       `json:"stdinInput"`
+	ProjectIsCmd bool       `json:"projectIsCmd"`
+	CmdInput     string     `json:"cmdInput"`
+	CurrentDir   string     `json:"currentDir"`
+
+	// Only written by newer versions of nim (1.6 and 2.x write them all)
+	CacheVersion string     `json:"cacheVersion"`
+	ConfigFiles  []string   `json:"configFiles"`
+	CmdLine      string     `json:"cmdline"`
+	DepFiles     [][]string `json:"depfiles"`
+	NimExe       string     `json:"nimexe"`
 }
 
 // nimCmd - Execute a nim command
@@ -38,7 +57,9 @@ func nimCmd(wd string, env []string, command []string) ([]byte, []byte, error) {
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	started := time.Now()
 	err := cmd.Run()
+	logger.Command(wd, env, append([]string{Nim}, command...), stdout.Bytes(), stderr.Bytes(), err, time.Since(started))
 	return stdout.Bytes(), stderr.Bytes(), err
 }
 
@@ -55,6 +76,15 @@ func Version() (string, error) {
 	return string(stdout), nil
 }
 
+// ParseVersion - The semantic version in `nim --version` output
+func ParseVersion(output string) (string, error) {
+	match := versionRegex.FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("Unrecognized nim version output")
+	}
+	return match[1], nil
+}
+
 // Compile - Nim compiler command
 func Compile(workDir string, env []string, args []string) ([]byte, []byte, error) {
 	cli := []string{"compile"}
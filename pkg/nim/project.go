@@ -0,0 +1,138 @@
+package nim
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type fieldKind string
+
+const (
+	stringField       fieldKind = "a string"
+	boolField         fieldKind = "a boolean"
+	stringListField   fieldKind = "a list of strings"
+	compileStepsField fieldKind = "a list of [C file, command] pairs"
+	stringPairsField  fieldKind = "a list of string pairs"
+)
+
+type projectField struct {
+	Name     string
+	Kind     fieldKind
+	Required bool
+}
+
+var (
+	// projectSchema - Every field of the JSON build instructions nim writes
+	// with --genScript, older versions of nim leave out the optional fields
+	projectSchema = []projectField{
+		{Name: "outputFile", Kind: stringField, Required: true},
+		{Name: "compile", Kind: compileStepsField, Required: true},
+		{Name: "link", Kind: stringListField, Required: true},
+		{Name: "linkcmd", Kind: stringField, Required: true},
+		{Name: "extraCmds", Kind: stringListField},
+		{Name: "stdinInput", Kind: boolField},
+		{Name: "projectIsCmd", Kind: boolField},
+		{Name: "cmdInput", Kind: stringField},
+		{Name: "currentDir", Kind: stringField},
+		{Name: "cacheVersion", Kind: stringField},
+		{Name: "configFiles", Kind: stringListField},
+		{Name: "cmdline", Kind: stringField},
+		{Name: "depfiles", Kind: stringPairsField},
+		{Name: "nimexe", Kind: stringField},
+	}
+)
+
+// ParseProject - Parse and validate nim's JSON build instructions
+func ParseProject(data []byte) (*Project, error) {
+	fields := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("not a JSON object (%s)", err)
+	}
+	problems := []string{}
+	for _, field := range projectSchema {
+		raw, ok := fields[field.Name]
+		if !ok || string(raw) == "null" {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("missing field '%s'", field.Name))
+			}
+			continue
+		}
+		if problem := validateField(field, raw); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if 0 < len(problems) {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	project := &Project{}
+	err = json.Unmarshal(data, project)
+	if err != nil {
+		return nil, err
+	}
+
+	// Older versions of nim may write an output file relative to the
+	// directory nim was run in
+	if !filepath.IsAbs(project.OutputFile) && project.CurrentDir != "" {
+		project.OutputFile = filepath.Join(project.CurrentDir, project.OutputFile)
+	}
+	return project, nil
+}
+
+func validateField(field projectField, raw json.RawMessage) string {
+	invalid := fmt.Sprintf("field '%s' should be %s", field.Name, field.Kind)
+	switch field.Kind {
+	case stringField:
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			return invalid
+		}
+		if field.Required && field.Name == "outputFile" && value == "" {
+			return fmt.Sprintf("field '%s' is empty", field.Name)
+		}
+	case boolField:
+		var value bool
+		if json.Unmarshal(raw, &value) != nil {
+			return invalid
+		}
+	case stringListField:
+		var value []string
+		if json.Unmarshal(raw, &value) != nil {
+			return invalid
+		}
+	case stringPairsField:
+		var value [][]string
+		if json.Unmarshal(raw, &value) != nil {
+			return invalid
+		}
+	case compileStepsField:
+		var value [][]string
+		if json.Unmarshal(raw, &value) != nil {
+			return invalid
+		}
+		for index, step := range value {
+			if len(step) != 2 || step[0] == "" || strings.TrimSpace(step[1]) == "" {
+				return fmt.Sprintf("field '%s' entry %d should be a [C file, command] pair, got %q", field.Name, index, step)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,135 @@
+package nim
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	// nim16Project - Written by nim 1.6 with --genScript
+	nim16Project = `{
+  "cacheVersion": "cacheVersion1",
+  "outputFile": "/src/main",
+  "compile": [
+    ["/cache/@mmain.nim.c", "clang -c -w -I/nim/lib -o /cache/@mmain.nim.c.o /cache/@mmain.nim.c"],
+    ["/cache/stdlib_system.nim.c", "clang -c -w -I/nim/lib -o /cache/stdlib_system.nim.c.o /cache/stdlib_system.nim.c"]
+  ],
+  "link": ["/cache/@mmain.nim.c.o", "/cache/stdlib_system.nim.c.o"],
+  "linkcmd": "clang -o /src/main /cache/@mmain.nim.c.o /cache/stdlib_system.nim.c.o -ldl",
+  "extraCmds": [],
+  "configFiles": ["/nim/config/nim.cfg"],
+  "stdinInput": false,
+  "projectIsCmd": false,
+  "cmdInput": "",
+  "currentDir": "/src",
+  "cmdline": "c --genScript main.nim",
+  "depfiles": [["/src/main.nim", "8d3c"]],
+  "nimexe": "/nim/bin/nim"
+}`
+
+	// nim2Project - Written by nim 2.x with --genScript
+	nim2Project = `{
+  "cacheVersion": "cacheVersion1",
+  "outputFile": "/src/main",
+  "compile": [
+    ["/cache/@mmain.nim.c", "clang -c -w -I/nim/lib -o /cache/@mmain.nim.c.o /cache/@mmain.nim.c"]
+  ],
+  "link": ["/cache/@mmain.nim.c.o"],
+  "linkcmd": "clang -o /src/main /cache/@mmain.nim.c.o -lm -ldl",
+  "extraCmds": [],
+  "configFiles": ["/nim/config/nim.cfg", "/nim/config/config.nims"],
+  "stdinInput": false,
+  "projectIsCmd": false,
+  "cmdInput": "",
+  "currentDir": "/src",
+  "cmdline": "c --genScript --mm:orc main.nim",
+  "depfiles": [["/src/main.nim", "1a2b"], ["/nim/lib/system.nim", "3c4d"]],
+  "nimexe": "/nim/bin/nim"
+}`
+)
+
+func TestParseProject(t *testing.T) {
+	project, err := ParseProject([]byte(nim16Project))
+	if err != nil {
+		t.Fatalf("ParseProject(1.6) error: %s", err)
+	}
+	if project.OutputFile != "/src/main" || len(project.Compile) != 2 || len(project.Link) != 2 {
+		t.Fatalf("ParseProject(1.6) got: %+v", project)
+	}
+	if project.CacheVersion != "cacheVersion1" || project.NimExe != "/nim/bin/nim" {
+		t.Fatalf("ParseProject(1.6) missed optional fields: %+v", project)
+	}
+
+	project, err = ParseProject([]byte(nim2Project))
+	if err != nil {
+		t.Fatalf("ParseProject(2.x) error: %s", err)
+	}
+	wantDeps := [][]string{{"/src/main.nim", "1a2b"}, {"/nim/lib/system.nim", "3c4d"}}
+	if !reflect.DeepEqual(project.DepFiles, wantDeps) {
+		t.Fatalf("ParseProject(2.x) depfiles got: %v, want: %v", project.DepFiles, wantDeps)
+	}
+
+	// Only the required fields, with an output file relative to currentDir
+	project, err = ParseProject([]byte(`{"outputFile": "main", "compile": [], "link": [], "linkcmd": "clang", "currentDir": "/src"}`))
+	if err != nil {
+		t.Fatalf("ParseProject(minimal) error: %s", err)
+	}
+	if project.OutputFile != "/src/main" {
+		t.Fatalf("ParseProject(minimal) outputFile got: %s, want: /src/main", project.OutputFile)
+	}
+}
+
+func TestParseProjectInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "not json",
+			data: `nim`,
+			err:  "not a JSON object (invalid character 'i' in literal null (expecting 'u'))",
+		},
+		{
+			name: "missing fields",
+			data: `{"outputFile": "/src/main"}`,
+			err:  "missing field 'compile'; missing field 'link'; missing field 'linkcmd'",
+		},
+		{
+			name: "empty output",
+			data: `{"outputFile": "", "compile": [], "link": [], "linkcmd": "clang"}`,
+			err:  "field 'outputFile' is empty",
+		},
+		{
+			name: "wrong types",
+			data: `{"outputFile": "/src/main", "compile": [], "link": "main.o", "linkcmd": "clang", "stdinInput": "no"}`,
+			err:  "field 'link' should be a list of strings; field 'stdinInput' should be a boolean",
+		},
+		{
+			name: "malformed step",
+			data: `{"outputFile": "/src/main", "compile": [["main.c"]], "link": [], "linkcmd": "clang"}`,
+			err:  `field 'compile' entry 0 should be a [C file, command] pair, got ["main.c"]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseProject([]byte(test.data))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("ParseProject() error: %v, want: %s", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"io/ioutil"
+	"regexp"
+)
+
+var (
+	// obfuscator-llvm checks functions for annotate("<pass>") to opt in and
+	// annotate("no<pass>") to opt out, regardless of the -mllvm switches
+	passAnnotationRegex = regexp.MustCompile(`annotate\("(bcf|sub|fla)"\)`)
+)
+
+// UsesAnnotations - Check if C code opts functions in to obfuscation with
+// annotations, in which case it should be compiled in annotation mode
+func UsesAnnotations(cFile string) (bool, error) {
+	data, err := ioutil.ReadFile(cFile)
+	if err != nil {
+		return false, err
+	}
+	return passAnnotationRegex.Match(data), nil
+}
+
+// WithAnnotations - A copy of obfArgs in annotation mode
+func WithAnnotations(obfArgs *ObfArgs) *ObfArgs {
+	annotated := *obfArgs
+	annotated.Annotations = true
+	return &annotated
+}
@@ -2,15 +2,15 @@ package ollvm
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
+	"time"
 
-	"github.com/moloch--/denim/pkg/assets"
+	"github.com/moloch--/denim/pkg/logger"
 )
 
 /*
@@ -42,6 +42,13 @@ type Clang struct {
 	ClangRootDir string
 	ClangBinDir  string
 	ClangExe     string
+
+	// Cross-compilation, empty uses the toolchain's defaults
+	Triple  string
+	Sysroot string
+
+	// Capabilities - Populated by Probe()
+	Capabilities *Capabilities
 }
 
 // ObfArgs - Build options
@@ -60,15 +67,27 @@ type ObfArgs struct {
 	Flatten      bool `json:"flaten"`
 	FlattenSplit int  `json:"flatten_split"`
 
+	// String and constant encryption
+	StringEncryption   bool `json:"string_encryption"`
+	ConstantEncryption bool `json:"constant_encryption"`
+
 	AESSeed string `json:"aes_seed"`
+
+	// Annotations - Only obfuscate functions annotated with a pass, the
+	// pass options and string/constant encryption still apply
+	Annotations bool `json:"annotations"`
+
+	// Pipeline - Run these passes in order with opt instead of letting
+	// clang pick the order, the pass options above still apply
+	Pipeline []*Pass `json:"pipeline,omitempty"`
 }
 
 // InitClang - Initalize a Clang struct
 func InitClang(clangDir string) (*Clang, error) {
 	clang := &Clang{
 		ClangRootDir: clangDir,
-		ClangBinDir:  path.Join(clangDir, "bin"),
-		ClangExe:     path.Join(clangDir, "bin", "clang.exe"),
+		ClangBinDir:  filepath.Join(clangDir, "bin"),
+		ClangExe:     filepath.Join(clangDir, "bin", ClangExeName),
 	}
 	if _, err := os.Stat(clang.ClangRootDir); os.IsNotExist(err) {
 		return nil, err
@@ -79,17 +98,27 @@ func InitClang(clangDir string) (*Clang, error) {
 	return clang, nil
 }
 
+// Identity - Identifies the toolchain's exact build, any change to the
+// clang binary or its target changes the identity
+func (c *Clang) Identity() (string, error) {
+	info, err := os.Stat(c.ClangExe)
+	if err != nil {
+		return "", err
+	}
+	version, err := c.Version()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%d|%d|%s|%s|%s", c.ClangExe, info.Size(), info.ModTime().UnixNano(), version, c.Triple, c.Sysroot), nil
+}
+
 // Version - Get clang version info
 func (c *Clang) Version() (string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return "", err
 	}
-	mingwBinDir := filepath.Join(assets.GetMingwDir(), "bin")
-	env := []string{
-		fmt.Sprintf("PATH=%s;%s", c.ClangBinDir, mingwBinDir),
-	}
-	stdout, stderr, err := c.clangCmd(cwd, env, []string{"--version"})
+	stdout, stderr, err := c.clangCmd(cwd, []string{"--version"})
 	if err != nil {
 		return string(stderr), err
 	}
@@ -98,38 +127,100 @@ func (c *Clang) Version() (string, error) {
 
 // ObfCompile - Compile obfuscated C code
 func (c *Clang) ObfCompile(wd string, args []string, obfArgs *ObfArgs) ([]byte, []byte, error) {
-	err := c.verifyObfArgs(obfArgs)
+	return c.ObfCompileContext(context.Background(), wd, args, obfArgs)
+}
+
+// ObfCompileContext - Compile obfuscated C code, killing clang if ctx is done
+func (c *Clang) ObfCompileContext(ctx context.Context, wd string, args []string, obfArgs *ObfArgs) ([]byte, []byte, error) {
+	if 0 < len(obfArgs.Pipeline) {
+		return c.pipelineCompile(ctx, wd, args, obfArgs)
+	}
+	command, err := c.ObfCompileArgs(args, obfArgs)
 	if err != nil {
 		return []byte{}, []byte{}, err
 	}
-	mingwBinDir := filepath.Join(assets.GetMingwDir(), "bin")
-	env := []string{
-		fmt.Sprintf("PATH=%s;%s", c.ClangBinDir, mingwBinDir),
+	return c.clangCmdContext(ctx, wd, command)
+}
+
+// ObfCompileArgs - The full clang argv ObfCompile will use, for a pipeline
+// this is the frontend's argv since the passes run separately with opt
+func (c *Clang) ObfCompileArgs(args []string, obfArgs *ObfArgs) ([]string, error) {
+	err := c.verifyObfArgs(obfArgs)
+	if err != nil {
+		return nil, err
+	}
+	command := c.targetArgs()
+	if 0 < len(obfArgs.Pipeline) {
+		command = append(command, c.getCmdEncryptionArgs(obfArgs)...)
+	} else {
+		command = append(command, c.getCmdObfArgs(obfArgs)...)
 	}
-	command := c.getCmdObfArgs(obfArgs)
 	command = append(command, args...)
-	return c.clangCmd(wd, env, command)
+	return command, nil
 }
 
 // Compile - Compile C code (no obfuscation)
 func (c *Clang) Compile(wd string, args []string) ([]byte, []byte, error) {
-	mingwBinDir := filepath.Join(assets.GetMingwDir(), "bin")
-	env := []string{
-		fmt.Sprintf("PATH=%s;%s", c.ClangBinDir, mingwBinDir),
+	return c.CompileContext(context.Background(), wd, args)
+}
+
+// CompileContext - Compile C code (no obfuscation), killing clang if ctx is done
+func (c *Clang) CompileContext(ctx context.Context, wd string, args []string) ([]byte, []byte, error) {
+	return c.clangCmdContext(ctx, wd, c.CompileArgs(args))
+}
+
+// CompileArgs - The full clang argv Compile will use
+func (c *Clang) CompileArgs(args []string) []string {
+	command := c.targetArgs()
+	command = append(command, args...)
+	return command
+}
+
+// targetArgs - Target triple and sysroot for cross-compilation
+func (c *Clang) targetArgs() []string {
+	args := []string{}
+	if c.Triple != "" {
+		args = append(args, fmt.Sprintf("--target=%s", c.Triple))
+	}
+	if c.Sysroot != "" {
+		args = append(args, fmt.Sprintf("--sysroot=%s", c.Sysroot))
 	}
-	return c.clangCmd(wd, env, args)
+	return args
 }
 
-// clangCmd - Execute a nim command
-func (c *Clang) clangCmd(wd string, env []string, command []string) ([]byte, []byte, error) {
-	cmd := exec.Command(c.ClangExe, command...)
+// clangCmd - Execute a clang command
+func (c *Clang) clangCmd(wd string, command []string) ([]byte, []byte, error) {
+	return c.clangCmdContext(context.Background(), wd, command)
+}
+
+func (c *Clang) clangCmdContext(ctx context.Context, wd string, command []string) ([]byte, []byte, error) {
+	return c.toolCmdContext(ctx, c.ClangExe, wd, command)
+}
+
+// toolCmd - Execute another tool from the toolchain
+func (c *Clang) toolCmd(tool string, wd string, command []string) ([]byte, []byte, error) {
+	return c.toolCmdContext(context.Background(), tool, wd, command)
+}
+
+func (c *Clang) toolCmdContext(ctx context.Context, tool string, wd string, command []string) ([]byte, []byte, error) {
+	env, err := c.env()
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+	return execCmd(ctx, tool, wd, env, command)
+}
+
+func execCmd(ctx context.Context, exe string, wd string, env []string, command []string) ([]byte, []byte, error) {
+	cmd := exec.CommandContext(ctx, exe, command...)
 	cmd.Dir = wd
 	cmd.Env = env
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
+	started := time.Now()
 	err := cmd.Run()
+	logger.Command(wd, env, append([]string{exe}, command...), stdout.Bytes(), stderr.Bytes(), err, time.Since(started))
 	return stdout.Bytes(), stderr.Bytes(), err
 }
 
@@ -146,45 +237,100 @@ func (c *Clang) verifyObfArgs(obfArgs *ObfArgs) error {
 	if obfArgs.Flatten && MaxSplit < obfArgs.FlattenSplit {
 		return fmt.Errorf("Flatten split cannot exceed %d", MaxSplit)
 	}
+	if 0 < len(obfArgs.Pipeline) {
+		err := c.verifyPipeline(obfArgs.Pipeline)
+		if err != nil {
+			return err
+		}
+		obfArgs = &ObfArgs{
+			StringEncryption:   obfArgs.StringEncryption,
+			ConstantEncryption: obfArgs.ConstantEncryption,
+		}
+	}
+	// In order, so the same args always report the same error
+	passes := []struct {
+		option  string
+		enabled bool
+	}{
+		{OptBCF, obfArgs.BCF},
+		{OptSub, obfArgs.Sub},
+		{OptFlatten, obfArgs.Flatten},
+		{OptStringEncryption, obfArgs.StringEncryption},
+		{OptConstantEncryption, obfArgs.ConstantEncryption},
+	}
+	for _, pass := range passes {
+		if pass.enabled && !c.Supports(pass.option) {
+			return fmt.Errorf("Toolchain (%s) does not support %s", c.flavor(), passOptions[pass.option])
+		}
+	}
 	return nil
 }
 
+func (c *Clang) flavor() string {
+	if c.Capabilities == nil {
+		return "unknown"
+	}
+	return c.Capabilities.Flavor
+}
+
 func (c *Clang) getCmdObfArgs(obfArgs *ObfArgs) []string {
 	cmdArgs := []string{}
 
 	if obfArgs.BCF {
-		cmdArgs = append(cmdArgs, []string{"-mllvm", "-bcf"}...)
-		bcfProb := fmt.Sprintf("-bcf_prob=%d", getIntArg(obfArgs.BCFProb))
-		cmdArgs = append(cmdArgs, []string{"-mllvm", bcfProb}...)
-		bcfLoop := fmt.Sprintf("-bcf_loop=%d", getIntArg(obfArgs.BCFLoop))
-		cmdArgs = append(cmdArgs, []string{"-mllvm", bcfLoop}...)
+		if !obfArgs.Annotations {
+			cmdArgs = append(cmdArgs, c.mllvm(OptBCF, "")...)
+		}
+		bcfProb := fmt.Sprintf("%d", getIntArg(obfArgs.BCFProb))
+		cmdArgs = append(cmdArgs, c.mllvm(OptBCFProb, bcfProb)...)
+		bcfLoop := fmt.Sprintf("%d", getIntArg(obfArgs.BCFLoop))
+		cmdArgs = append(cmdArgs, c.mllvm(OptBCFLoop, bcfLoop)...)
 	}
 	if obfArgs.Sub {
-		cmdArgs = append(cmdArgs, []string{"-mllvm", "-sub"}...)
-		subLoop := fmt.Sprintf("-sub_loop=%d", getIntArg(obfArgs.SubLoop))
-		cmdArgs = append(cmdArgs, []string{"-mllvm", subLoop}...)
+		if !obfArgs.Annotations {
+			cmdArgs = append(cmdArgs, c.mllvm(OptSub, "")...)
+		}
+		subLoop := fmt.Sprintf("%d", getIntArg(obfArgs.SubLoop))
+		cmdArgs = append(cmdArgs, c.mllvm(OptSubLoop, subLoop)...)
 	}
-	if obfArgs.AESSeed == "" {
-		obfArgs.AESSeed = randomSeed()
+	if obfArgs.Flatten {
+		if !obfArgs.Annotations {
+			cmdArgs = append(cmdArgs, c.mllvm(OptFlatten, "")...)
+			cmdArgs = append(cmdArgs, c.mllvm(OptSplit, "")...)
+		}
+		splitNum := fmt.Sprintf("%d", getIntArg(obfArgs.FlattenSplit))
+		cmdArgs = append(cmdArgs, c.mllvm(OptSplitNum, splitNum)...)
+	}
+	cmdArgs = append(cmdArgs, c.getCmdEncryptionArgs(obfArgs)...)
+	cmdArgs = append(cmdArgs, c.mllvm(OptAESSeed, aesSeed(obfArgs.AESSeed))...)
+	return cmdArgs
+}
+
+// getCmdEncryptionArgs - String and constant encryption run in clang's
+// frontend, even for a pipeline
+func (c *Clang) getCmdEncryptionArgs(obfArgs *ObfArgs) []string {
+	cmdArgs := []string{}
+	if obfArgs.StringEncryption {
+		cmdArgs = append(cmdArgs, c.mllvm(OptStringEncryption, "")...)
+	}
+	if obfArgs.ConstantEncryption {
+		cmdArgs = append(cmdArgs, c.mllvm(OptConstantEncryption, "")...)
 	}
-	digest := sha256.New()
-	digest.Write([]byte(obfArgs.AESSeed))
-	aesSeed := fmt.Sprintf("-aesSeed=%x", digest.Sum(nil)[:16])
-	cmdArgs = append(cmdArgs, []string{"-mllvm", aesSeed}...)
 	return cmdArgs
 }
 
+// aesSeed - The passes' PRNG seed (128-bit hex) derived from the build seed
+func aesSeed(seed string) string {
+	if seed == "" {
+		seed = RandomSeed()
+	}
+	digest := sha256.New()
+	digest.Write([]byte(seed))
+	return fmt.Sprintf("%x", digest.Sum(nil)[:16])
+}
+
 func getIntArg(x int) int {
 	if x < 1 {
 		return 1
 	}
 	return x
 }
-
-func randomSeed() string {
-	buf := make([]byte, 32)
-	rand.Read(buf)
-	digest := sha256.New()
-	digest.Write(buf)
-	return fmt.Sprintf("%x", digest.Sum(nil))
-}
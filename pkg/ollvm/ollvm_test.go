@@ -0,0 +1,277 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSeed = "denim"
+
+var (
+	hikari = &Capabilities{
+		Flavor: "hikari",
+		Options: map[string]string{
+			OptBCF:                "enable-bcfobf",
+			OptBCFProb:            "bcf_prob",
+			OptBCFLoop:            "bcf_loop",
+			OptSub:                "enable-subobf",
+			OptSubLoop:            "sub_loop",
+			OptFlatten:            "enable-cffobf",
+			OptSplit:              "enable-splitobf",
+			OptSplitNum:           "split_num",
+			OptAESSeed:            "aesSeed",
+			OptStringEncryption:   "enable-strcry",
+			OptConstantEncryption: "enable-constenc",
+		},
+	}
+	arkari = &Capabilities{
+		Flavor: "arkari",
+		Options: map[string]string{
+			OptFlatten:            "irobf-cff",
+			OptStringEncryption:   "irobf-cse",
+			OptConstantEncryption: "irobf-cie",
+		},
+	}
+)
+
+func testAESSeed() string {
+	digest := sha256.Sum256([]byte(testSeed))
+	return fmt.Sprintf("%x", digest[:16])
+}
+
+// mllvm - Expected -mllvm pairs for switches
+func mllvm(switches ...string) []string {
+	args := []string{}
+	for _, name := range switches {
+		args = append(args, "-mllvm", "-"+name)
+	}
+	return args
+}
+
+func TestGetCmdObfArgs(t *testing.T) {
+	seed := "aesSeed=" + testAESSeed()
+	tests := []struct {
+		name         string
+		capabilities *Capabilities
+		obfArgs      *ObfArgs
+		want         []string
+	}{
+		{
+			name:    "none",
+			obfArgs: &ObfArgs{AESSeed: testSeed},
+			want:    mllvm(seed),
+		},
+		{
+			name:    "bcf",
+			obfArgs: &ObfArgs{BCF: true, BCFProb: 40, BCFLoop: 3, AESSeed: testSeed},
+			want:    mllvm("bcf", "bcf_prob=40", "bcf_loop=3", seed),
+		},
+		{
+			name:    "bcf defaults",
+			obfArgs: &ObfArgs{BCF: true, AESSeed: testSeed},
+			want:    mllvm("bcf", "bcf_prob=1", "bcf_loop=1", seed),
+		},
+		{
+			name:    "sub",
+			obfArgs: &ObfArgs{Sub: true, SubLoop: 2, AESSeed: testSeed},
+			want:    mllvm("sub", "sub_loop=2", seed),
+		},
+		{
+			name:    "flatten",
+			obfArgs: &ObfArgs{Flatten: true, FlattenSplit: 4, AESSeed: testSeed},
+			want:    mllvm("fla", "split", "split_num=4", seed),
+		},
+		{
+			name: "all passes",
+			obfArgs: &ObfArgs{
+				BCF: true, BCFProb: 100, BCFLoop: 5,
+				Sub: true, SubLoop: 4,
+				Flatten: true, FlattenSplit: 5,
+				AESSeed: testSeed,
+			},
+			want: mllvm("bcf", "bcf_prob=100", "bcf_loop=5", "sub", "sub_loop=4", "fla", "split", "split_num=5", seed),
+		},
+		{
+			name: "annotations",
+			obfArgs: &ObfArgs{
+				BCF: true, BCFProb: 30, BCFLoop: 2,
+				Sub: true, SubLoop: 3,
+				Flatten: true, FlattenSplit: 2,
+				AESSeed:     testSeed,
+				Annotations: true,
+			},
+			want: mllvm("bcf_prob=30", "bcf_loop=2", "sub_loop=3", "split_num=2", seed),
+		},
+		{
+			name:         "hikari",
+			capabilities: hikari,
+			obfArgs: &ObfArgs{
+				BCF: true, BCFProb: 50, BCFLoop: 2,
+				Sub: true, SubLoop: 1,
+				Flatten: true, FlattenSplit: 3,
+				StringEncryption: true, ConstantEncryption: true,
+				AESSeed: testSeed,
+			},
+			want: mllvm("enable-bcfobf", "bcf_prob=50", "bcf_loop=2", "enable-subobf", "sub_loop=1",
+				"enable-cffobf", "enable-splitobf", "split_num=3", "enable-strcry", "enable-constenc", seed),
+		},
+		{
+			name:         "hikari annotations",
+			capabilities: hikari,
+			obfArgs: &ObfArgs{
+				Flatten: true, FlattenSplit: 3,
+				StringEncryption: true,
+				AESSeed:          testSeed,
+				Annotations:      true,
+			},
+			want: mllvm("split_num=3", "enable-strcry", seed),
+		},
+		{
+			name:         "arkari",
+			capabilities: arkari,
+			obfArgs: &ObfArgs{
+				Flatten: true, FlattenSplit: 3,
+				StringEncryption: true, ConstantEncryption: true,
+				AESSeed: testSeed,
+			},
+			want: mllvm("irobf-cff", "irobf-cse", "irobf-cie"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clang := &Clang{Capabilities: test.capabilities}
+			err := clang.verifyObfArgs(test.obfArgs)
+			if err != nil {
+				t.Fatalf("verifyObfArgs() error: %s", err)
+			}
+			got := clang.getCmdObfArgs(test.obfArgs)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("getCmdObfArgs()\n got: %v\nwant: %v", got, test.want)
+			}
+			for index := 0; index < len(got); index += 2 {
+				if got[index] != "-mllvm" || !strings.HasPrefix(got[index+1], "-") {
+					t.Fatalf("Not an -mllvm pair at %d: %v", index, got)
+				}
+			}
+		})
+	}
+}
+
+// TestDroppedOptions - Every requested option is either in the argv, an
+// error, or reported by Unsupported()
+func TestDroppedOptions(t *testing.T) {
+	clang := &Clang{Capabilities: arkari}
+	obfArgs := &ObfArgs{Flatten: true, FlattenSplit: 3, AESSeed: testSeed}
+	got := clang.Unsupported(obfArgs)
+	want := []string{OptSplit, OptSplitNum, OptAESSeed}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unsupported()\n got: %v\nwant: %v", got, want)
+	}
+
+	unprobed := &Clang{}
+	obfArgs = &ObfArgs{BCF: true, Sub: true, Flatten: true}
+	if got := unprobed.Unsupported(obfArgs); len(got) != 0 {
+		t.Fatalf("Unsupported() for obfuscator-llvm: %v", got)
+	}
+}
+
+func TestVerifyObfArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities *Capabilities
+		obfArgs      *ObfArgs
+		err          string
+	}{
+		{
+			name:    "bcf probability",
+			obfArgs: &ObfArgs{BCF: true, BCFProb: MaxProb + 1},
+			err:     "BFC probability cannot exceed 100",
+		},
+		{
+			name:    "bcf loop",
+			obfArgs: &ObfArgs{BCF: true, BCFLoop: MaxBCFLoop + 1},
+			err:     "BCF loop cannot exceed 5",
+		},
+		{
+			name:    "sub loop",
+			obfArgs: &ObfArgs{Sub: true, SubLoop: MaxSubLoop + 1},
+			err:     "Substitution loop cannot exceed 4",
+		},
+		{
+			name:    "flatten split",
+			obfArgs: &ObfArgs{Flatten: true, FlattenSplit: MaxSplit + 1},
+			err:     "Flatten split cannot exceed 5",
+		},
+		{
+			name:         "unsupported pass",
+			capabilities: arkari,
+			obfArgs:      &ObfArgs{BCF: true},
+			err:          "Toolchain (arkari) does not support bogus control flow",
+		},
+		{
+			name:         "unsupported encryption",
+			capabilities: &Capabilities{Flavor: "obfuscator-llvm", Options: map[string]string{OptBCF: "bcf"}},
+			obfArgs:      &ObfArgs{ConstantEncryption: true},
+			err:          "Toolchain (obfuscator-llvm) does not support constant encryption",
+		},
+		{
+			name:    "unprobed encryption",
+			obfArgs: &ObfArgs{StringEncryption: true},
+			err:     "Toolchain (unknown) does not support string encryption",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clang := &Clang{Capabilities: test.capabilities}
+			err := clang.verifyObfArgs(test.obfArgs)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("verifyObfArgs() error: %v, want: %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestObfCompileArgs(t *testing.T) {
+	clang := &Clang{Triple: "x86_64-w64-mingw32", Sysroot: "/sysroot"}
+	obfArgs := &ObfArgs{Sub: true, SubLoop: 2, AESSeed: testSeed}
+	got, err := clang.ObfCompileArgs([]string{"-c", "main.c", "-o", "main.o"}, obfArgs)
+	if err != nil {
+		t.Fatalf("ObfCompileArgs() error: %s", err)
+	}
+	want := []string{"--target=x86_64-w64-mingw32", "--sysroot=/sysroot"}
+	want = append(want, mllvm("sub", "sub_loop=2", "aesSeed="+testAESSeed())...)
+	want = append(want, "-c", "main.c", "-o", "main.o")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ObfCompileArgs()\n got: %v\nwant: %v", got, want)
+	}
+}
+
+// TestVerifyObfArgsOrder - The first unsupported pass is always the one
+// reported
+func TestVerifyObfArgsOrder(t *testing.T) {
+	clang := &Clang{Capabilities: arkari}
+	obfArgs := &ObfArgs{BCF: true, Sub: true, StringEncryption: true}
+	for index := 0; index < 20; index++ {
+		err := clang.verifyObfArgs(obfArgs)
+		want := "Toolchain (arkari) does not support bogus control flow"
+		if err == nil || err.Error() != want {
+			t.Fatalf("verifyObfArgs() error: %v, want: %s", err, want)
+		}
+	}
+}
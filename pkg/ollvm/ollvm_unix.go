@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// ClangExeName - Name of the clang executable
+	ClangExeName = "clang"
+)
+
+// env - Clang uses the host's linker, headers, and libs on Linux
+func (c *Clang) env() ([]string, error) {
+	return []string{
+		fmt.Sprintf("PATH=%s%c%s", c.ClangBinDir, os.PathListSeparator, os.Getenv("PATH")),
+	}, nil
+}
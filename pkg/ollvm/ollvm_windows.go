@@ -0,0 +1,45 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moloch--/denim/pkg/assets"
+)
+
+const (
+	// ClangExeName - Name of the clang executable
+	ClangExeName = "clang.exe"
+)
+
+// env - Clang relies on the mingw-w64 binutils, headers, and libs on Windows,
+// a cross-compilation sysroot's binutils take precedence
+func (c *Clang) env() ([]string, error) {
+	binDirs := []string{c.ClangBinDir}
+	if c.Sysroot != "" {
+		binDirs = append(binDirs, filepath.Join(c.Sysroot, "bin"))
+	}
+	mingwDir, err := assets.GetMingwDir()
+	if err != nil {
+		return nil, err
+	}
+	binDirs = append(binDirs, filepath.Join(mingwDir, "bin"))
+	return []string{
+		fmt.Sprintf("PATH=%s", strings.Join(binDirs, string(os.PathListSeparator))),
+	}, nil
+}
@@ -0,0 +1,336 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// PipelinePasses - Passes a pipeline can run, in a stable order
+	PipelinePasses = []string{OptSub, OptFlatten, OptBCF, OptSplit}
+
+	// optPasses - The name each pass is registered with in opt
+	optPasses = map[string]string{
+		OptBCF:     "boguscf",
+		OptSub:     "substitution",
+		OptFlatten: "flattening",
+		OptSplit:   "splitbbl",
+	}
+
+	sourceExts = []string{".c", ".cc", ".cpp", ".cxx", ".m", ".bc"}
+)
+
+// pipelineProgram - Arithmetic, branches, and a loop, so every pipeline pass
+// has something to change
+const pipelineProgram = `int denim(int a, int b) {
+	int r = 0;
+	for (int i = 0; i < a; i++) {
+		if (i % 3 == 0) {
+			r += a ^ b;
+		} else {
+			r -= b + i;
+		}
+	}
+	return r;
+}
+`
+
+// Pass - A pass of an explicit pipeline and the number of times it runs
+type Pass struct {
+	Name       string `json:"name"`
+	Iterations int    `json:"iterations"`
+}
+
+// ParsePipeline - Parse an ordered list of passes with optional iteration
+// counts e.g. "sub:2,fla,bcf:3"
+func ParsePipeline(spec string) ([]*Pass, error) {
+	pipeline := []*Pass{}
+	for _, pass := range strings.Split(spec, ",") {
+		passParts := strings.SplitN(strings.TrimSpace(pass), ":", 2)
+		if _, ok := optPasses[passParts[0]]; !ok {
+			return nil, fmt.Errorf("Unknown pipeline pass '%s' (valid passes: %s)", passParts[0], strings.Join(PipelinePasses, ", "))
+		}
+		iterations := 1
+		if len(passParts) == 2 {
+			var err error
+			iterations, err = strconv.Atoi(passParts[1])
+			if err != nil || iterations < 1 {
+				return nil, fmt.Errorf("Invalid iterations in '%s'", pass)
+			}
+		}
+		pipeline = append(pipeline, &Pass{Name: passParts[0], Iterations: iterations})
+	}
+	return pipeline, nil
+}
+
+// PipelineHas - Check if a pipeline runs a pass
+func PipelineHas(pipeline []*Pass, name string) bool {
+	for _, pass := range pipeline {
+		if pass.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PipelineString - Format a pipeline the way ParsePipeline expects it
+func PipelineString(pipeline []*Pass) string {
+	passes := []string{}
+	for _, pass := range pipeline {
+		passes = append(passes, fmt.Sprintf("%s:%d", pass.Name, pass.Iterations))
+	}
+	return strings.Join(passes, ",")
+}
+
+// SupportsPass - Check if the toolchain's opt has a pipeline pass, we
+// assume a toolchain we haven't probed does
+func (c *Clang) SupportsPass(name string) bool {
+	if c.Capabilities == nil {
+		return true
+	}
+	return c.Capabilities.Passes[name]
+}
+
+// probePasses - The pipeline passes registered in the toolchain's opt, none
+// if it doesn't ship opt
+func (c *Clang) probePasses(wd string) map[string]bool {
+	passes := map[string]bool{}
+	opt := c.findTool("opt")
+	if opt == "" {
+		return passes
+	}
+	stdout, _, _ := c.toolCmd(opt, wd, []string{"--help"})
+	switches := parseHelpOptions(stdout)
+	for name, optPass := range optPasses {
+		passes[name] = switches[optPass]
+	}
+	return passes
+}
+
+func (c *Clang) verifyPipeline(pipeline []*Pass) error {
+	if c.findTool("opt") == "" {
+		return fmt.Errorf("Toolchain (%s) has no opt, which is required to run a pipeline", c.flavor())
+	}
+	for _, pass := range pipeline {
+		if !c.SupportsPass(pass.Name) {
+			return fmt.Errorf("Toolchain (%s) opt does not have the %s pass (%s)", c.flavor(), pass.Name, optPasses[pass.Name])
+		}
+	}
+	return nil
+}
+
+// CheckPipeline - Run each of the pipeline's passes over a small program
+// with opt and check the IR changed. Some toolchains (e.g. stock
+// obfuscator-llvm) register passes in opt that only run on functions
+// annotated for them, so opt succeeds without obfuscating anything.
+func (c *Clang) CheckPipeline(pipeline []*Pass) error {
+	opt := c.findTool("opt")
+	if opt == "" {
+		return fmt.Errorf("Toolchain (%s) has no opt, which is required to run a pipeline", c.flavor())
+	}
+	workDir, err := ioutil.TempDir("", "denim-pipeline")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	err = ioutil.WriteFile(filepath.Join(workDir, "pipeline.c"), []byte(pipelineProgram), 0600)
+	if err != nil {
+		return err
+	}
+	// -O0 would mark the function optnone, so disable the optimizer instead
+	frontend := BitcodeArgs([]string{"-O1", "-Xclang", "-disable-llvm-passes", "pipeline.c"}, "pipeline.bc")
+	_, stderr, err := c.Compile(workDir, frontend)
+	if err != nil {
+		return fmt.Errorf("Failed to compile the pipeline check (%s) %s", err, stderr)
+	}
+	_, stderr, err = c.toolCmd(opt, workDir, []string{"-S", "pipeline.bc", "-o", "pipeline.ll"})
+	if err != nil {
+		return fmt.Errorf("Failed to run opt (%s) %s", err, stderr)
+	}
+	before, err := ioutil.ReadFile(filepath.Join(workDir, "pipeline.ll"))
+	if err != nil {
+		return err
+	}
+	for _, name := range PipelinePasses {
+		if !PipelineHas(pipeline, name) {
+			continue
+		}
+		obfArgs := &ObfArgs{
+			Pipeline: []*Pass{{Name: name, Iterations: 1}},
+			BCFProb:  MaxProb, BCFLoop: 1, SubLoop: 1, FlattenSplit: 1,
+			AESSeed: RandomSeed(),
+		}
+		optArgs := append(c.optArgs(obfArgs), "-S", "pipeline.bc", "-o", name+".ll")
+		_, stderr, err = c.toolCmd(opt, workDir, optArgs)
+		if err != nil {
+			return fmt.Errorf("Failed to run opt's %s pass (%s) %s", optPasses[name], err, stderr)
+		}
+		after, err := ioutil.ReadFile(filepath.Join(workDir, name+".ll"))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(before, after) {
+			return fmt.Errorf("Toolchain (%s) opt's %s pass (%s) does not change the code, it can't be used in a pipeline", c.flavor(), name, optPasses[name])
+		}
+	}
+	return nil
+}
+
+// pipelineCompile - Compile C code to bitcode, run the pipeline's passes in
+// order with opt, then generate the object with clang. Clang's optimizer is
+// disabled for codegen so it can't undo the obfuscation. If args ask for
+// LLVM IR (-emit-llvm) opt's output is the result.
+func (c *Clang) pipelineCompile(ctx context.Context, wd string, args []string, obfArgs *ObfArgs) ([]byte, []byte, error) {
+	stdout := []byte{}
+	stderr := []byte{}
+	output, source := pipelineFiles(args)
+	if output == "" || source == "" {
+		return stdout, stderr, fmt.Errorf("Pipeline could not find the source and output in %v", args)
+	}
+	if !filepath.IsAbs(output) {
+		output = filepath.Join(wd, output)
+	}
+	bitcode := output + ".bc"
+	obfBitcode := output + ".obf.bc"
+
+	// Frontend
+	frontend, err := c.ObfCompileArgs(BitcodeArgs(args, bitcode), obfArgs)
+	if err != nil {
+		return stdout, stderr, err
+	}
+	out, errOut, err := c.clangCmdContext(ctx, wd, frontend)
+	stdout, stderr = append(stdout, out...), append(stderr, errOut...)
+	if err != nil {
+		return stdout, stderr, err
+	}
+	defer os.Remove(bitcode)
+
+	// Passes
+	emitIR := hasArg(args, "-emit-llvm")
+	optOutput := obfBitcode
+	if emitIR {
+		optOutput = output
+	}
+	optArgs := c.optArgs(obfArgs)
+	if emitIR && hasArg(args, "-S") {
+		optArgs = append(optArgs, "-S")
+	}
+	optArgs = append(optArgs, bitcode, "-o", optOutput)
+	out, errOut, err = c.toolCmdContext(ctx, c.findTool("opt"), wd, optArgs)
+	stdout, stderr = append(stdout, out...), append(stderr, errOut...)
+	if err != nil || emitIR {
+		return stdout, stderr, err
+	}
+	defer os.Remove(obfBitcode)
+
+	// Codegen
+	codegen := []string{"-Xclang", "-disable-llvm-passes", "-Wno-unused-command-line-argument"}
+	for _, arg := range args {
+		if arg == source {
+			arg = obfBitcode
+		}
+		codegen = append(codegen, arg)
+	}
+	out, errOut, err = c.clangCmdContext(ctx, wd, c.CompileArgs(codegen))
+	stdout, stderr = append(stdout, out...), append(stderr, errOut...)
+	return stdout, stderr, err
+}
+
+// BitcodeArgs - Rewrite compile args to emit bitcode to output
+func BitcodeArgs(args []string, output string) []string {
+	bitcode := []string{"-c", "-emit-llvm"}
+	for index := 0; index < len(args); index++ {
+		switch args[index] {
+		case "-c", "-S", "-emit-llvm":
+			continue
+		case "-o":
+			index++ // Replaced by output
+			continue
+		}
+		bitcode = append(bitcode, args[index])
+	}
+	return append(bitcode, "-o", output)
+}
+
+// optArgs - The passes in order, followed by their options
+func (c *Clang) optArgs(obfArgs *ObfArgs) []string {
+	args := []string{}
+	for _, pass := range obfArgs.Pipeline {
+		for iteration := 0; iteration < pass.Iterations; iteration++ {
+			args = append(args, fmt.Sprintf("-%s", optPasses[pass.Name]))
+		}
+	}
+	options := []struct {
+		Pass   string
+		Option string
+		Value  int
+	}{
+		{Pass: OptBCF, Option: OptBCFProb, Value: getIntArg(obfArgs.BCFProb)},
+		{Pass: OptBCF, Option: OptBCFLoop, Value: getIntArg(obfArgs.BCFLoop)},
+		{Pass: OptSub, Option: OptSubLoop, Value: getIntArg(obfArgs.SubLoop)},
+		{Pass: OptSplit, Option: OptSplitNum, Value: getIntArg(obfArgs.FlattenSplit)},
+	}
+	for _, option := range options {
+		if !PipelineHas(obfArgs.Pipeline, option.Pass) {
+			continue
+		}
+		if name, ok := c.optionSwitch(option.Option); ok {
+			args = append(args, fmt.Sprintf("-%s=%d", name, option.Value))
+		}
+	}
+	if name, ok := c.optionSwitch(OptAESSeed); ok {
+		args = append(args, fmt.Sprintf("-%s=%s", name, aesSeed(obfArgs.AESSeed)))
+	}
+	return args
+}
+
+// pipelineFiles - The output and source file of a compile command
+func pipelineFiles(args []string) (string, string) {
+	output := ""
+	source := ""
+	for index := 0; index < len(args); index++ {
+		if args[index] == "-o" && index+1 < len(args) {
+			index++
+			output = args[index]
+			continue
+		}
+		if strings.HasPrefix(args[index], "-") {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(args[index]))
+		for _, sourceExt := range sourceExts {
+			if ext == sourceExt {
+				source = args[index]
+			}
+		}
+	}
+	return output, source
+}
+
+func hasArg(args []string, arg string) bool {
+	for _, value := range args {
+		if value == arg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Obfuscation options, named using the original obfuscator-llvm spelling
+const (
+	OptBCF      = "bcf"
+	OptBCFProb  = "bcf_prob"
+	OptBCFLoop  = "bcf_loop"
+	OptSub      = "sub"
+	OptSubLoop  = "sub_loop"
+	OptFlatten  = "fla"
+	OptSplit    = "split"
+	OptSplitNum = "split_num"
+	OptAESSeed  = "aesSeed"
+
+	// Only available in some forks (e.g. Hikari, Arkari)
+	OptStringEncryption   = "strcry"
+	OptConstantEncryption = "constenc"
+)
+
+var (
+	// optionAliases - The -mllvm switch each ollvm fork uses for an option,
+	// in order of preference
+	optionAliases = map[string][]string{
+		OptBCF:      {"bcf", "enable-bcfobf"},
+		OptBCFProb:  {"bcf_prob", "bcf-prob"},
+		OptBCFLoop:  {"bcf_loop", "bcf-loop"},
+		OptSub:      {"sub", "enable-subobf"},
+		OptSubLoop:  {"sub_loop", "sub-loop"},
+		OptFlatten:  {"fla", "enable-cffobf", "irobf-cff"},
+		OptSplit:    {"split", "enable-splitobf"},
+		OptSplitNum: {"split_num", "split-num"},
+		OptAESSeed:  {"aesSeed", "aes-seed"},
+
+		OptStringEncryption:   {"enable-strcry", "irobf-cse"},
+		OptConstantEncryption: {"enable-constenc", "irobf-cie"},
+	}
+
+	// passOptions - Options that enable a pass, we refuse to compile if
+	// the toolchain doesn't have them rather than silently skip the pass
+	passOptions = map[string]string{
+		OptBCF:     "bogus control flow",
+		OptSub:     "instruction substitution",
+		OptFlatten: "control flow flattening",
+
+		OptStringEncryption:   "string encryption",
+		OptConstantEncryption: "constant encryption",
+	}
+
+	// flavors - Identify a fork by name or by an option only it has
+	flavors = []struct {
+		Name    string
+		Keyword string
+		Option  string
+	}{
+		{Name: "arkari", Keyword: "arkari", Option: "irobf-cff"},
+		{Name: "pluto", Keyword: "pluto"},
+		{Name: "hikari", Keyword: "hikari", Option: "enable-bcfobf"},
+		{Name: "obfuscator-llvm", Keyword: "obfuscator-llvm", Option: "bcf"},
+	}
+
+	helpOptionRegex = regexp.MustCompile(`^\s+--?([A-Za-z0-9_.\-]+)`)
+)
+
+// Capabilities - What an obfuscating toolchain supports
+type Capabilities struct {
+	Version string `json:"version"`
+	Flavor  string `json:"flavor"`
+
+	// Options - Option name to the switch this toolchain uses for it
+	Options map[string]string `json:"options"`
+
+	// Passes - Pipeline passes available in the toolchain's opt
+	Passes map[string]bool `json:"passes"`
+}
+
+// Options - All obfuscation options in a stable order
+func Options() []string {
+	return []string{
+		OptBCF, OptBCFProb, OptBCFLoop,
+		OptSub, OptSubLoop,
+		OptFlatten, OptSplit, OptSplitNum,
+		OptAESSeed,
+		OptStringEncryption, OptConstantEncryption,
+	}
+}
+
+// Probe - Determine which obfuscation options the toolchain supports, the
+// result is cached on the Clang instance
+func (c *Clang) Probe() (*Capabilities, error) {
+	if c.Capabilities != nil {
+		return c.Capabilities, nil
+	}
+	version, err := c.Version()
+	if err != nil {
+		return nil, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stderr, err := c.clangCmd(cwd, []string{"-mllvm", "--help"})
+	switches := parseHelpOptions(stdout)
+	if len(switches) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no options found")
+		}
+		return nil, fmt.Errorf("Failed to list toolchain options (%s) %s", err, stderr)
+	}
+
+	capabilities := &Capabilities{
+		Version: strings.TrimSpace(strings.SplitN(version, "\n", 2)[0]),
+		Options: map[string]string{},
+	}
+	for option, aliases := range optionAliases {
+		for _, alias := range aliases {
+			if switches[alias] {
+				capabilities.Options[option] = alias
+				break
+			}
+		}
+	}
+	capabilities.Passes = c.probePasses(cwd)
+	capabilities.Flavor = "unknown"
+	for _, flavor := range flavors {
+		if strings.Contains(strings.ToLower(version), flavor.Keyword) || (flavor.Option != "" && switches[flavor.Option]) {
+			capabilities.Flavor = flavor.Name
+			break
+		}
+	}
+	c.Capabilities = capabilities
+	return capabilities, nil
+}
+
+// Supports - Check if the toolchain supports an option, we assume a
+// toolchain we haven't probed is obfuscator-llvm
+func (c *Clang) Supports(option string) bool {
+	_, ok := c.optionSwitch(option)
+	return ok
+}
+
+// Unsupported - Options set in obfArgs that the toolchain will ignore, an
+// unsupported pass is an error instead (see verifyObfArgs)
+func (c *Clang) Unsupported(obfArgs *ObfArgs) []string {
+	requested := []string{}
+	if obfArgs.BCF {
+		requested = append(requested, OptBCFProb, OptBCFLoop)
+	}
+	if obfArgs.Sub {
+		requested = append(requested, OptSubLoop)
+	}
+	if obfArgs.Flatten {
+		requested = append(requested, OptSplit, OptSplitNum)
+	}
+	requested = append(requested, OptAESSeed)
+	unsupported := []string{}
+	for _, option := range requested {
+		if !c.Supports(option) {
+			unsupported = append(unsupported, option)
+		}
+	}
+	return unsupported
+}
+
+// optionSwitch - Map an option to the switch this toolchain uses, an
+// unprobed toolchain is assumed to be stock obfuscator-llvm which has no
+// encryption passes
+func (c *Clang) optionSwitch(option string) (string, bool) {
+	if c.Capabilities == nil {
+		if option == OptStringEncryption || option == OptConstantEncryption {
+			return "", false
+		}
+		return optionAliases[option][0], true
+	}
+	name, ok := c.Capabilities.Options[option]
+	return name, ok
+}
+
+// mllvm - Format an option as clang args, or nothing if it's unsupported
+func (c *Clang) mllvm(option string, value string) []string {
+	name, ok := c.optionSwitch(option)
+	if !ok {
+		return []string{}
+	}
+	if value != "" {
+		return []string{"-mllvm", fmt.Sprintf("-%s=%s", name, value)}
+	}
+	return []string{"-mllvm", fmt.Sprintf("-%s", name)}
+}
+
+func parseHelpOptions(help []byte) map[string]bool {
+	switches := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(help))
+	for scanner.Scan() {
+		match := helpOptionRegex.FindStringSubmatch(scanner.Text())
+		if match != nil {
+			switches[match[1]] = true
+		}
+	}
+	return switches
+}
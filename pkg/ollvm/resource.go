@@ -0,0 +1,65 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// windresTargets - BFD target of windres for each triple
+	windresTargets = map[string]string{
+		"x86_64-w64-mingw32": "pe-x86-64",
+		"i686-w64-mingw32":   "pe-i386",
+	}
+)
+
+// CompileResource - Compile a Windows resource script (.rc) or compiled
+// resource (.res) to a COFF object the linker can use
+func (c *Clang) CompileResource(wd string, src string, dest string) ([]byte, []byte, error) {
+	windres, err := c.findWindres()
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+	args := []string{}
+	if target, ok := windresTargets[c.Triple]; ok {
+		args = append(args, fmt.Sprintf("--target=%s", target))
+	}
+	if strings.HasSuffix(strings.ToLower(src), ".res") {
+		args = append(args, "--input-format=res")
+	} else {
+		args = append(args, "--input-format=rc")
+		args = append(args, "-I", filepath.Dir(src))
+	}
+	args = append(args, "--output-format=coff", "-i", src, "-o", dest)
+	return c.toolCmd(windres, wd, args)
+}
+
+// findWindres - windres from mingw-w64 (the triple prefixed version when
+// cross-compiling) or llvm-windres from the toolchain
+func (c *Clang) findWindres() (string, error) {
+	names := []string{}
+	if c.Triple != "" {
+		names = append(names, fmt.Sprintf("%s-windres", c.Triple))
+	}
+	names = append(names, "windres", "llvm-windres")
+	for _, name := range names {
+		if tool := c.findTool(name); tool != "" {
+			return tool, nil
+		}
+	}
+	return "", fmt.Errorf("Could not find windres to compile resources (tried %s)", strings.Join(names, ", "))
+}
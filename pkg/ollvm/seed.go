@@ -0,0 +1,50 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	insecureRand "math/rand"
+	"path/filepath"
+)
+
+// RandomSeed - Generate a random obfuscation seed
+func RandomSeed() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	digest := sha256.New()
+	digest.Write(buf)
+	return fmt.Sprintf("%x", digest.Sum(nil))
+}
+
+// NewPRNG - A PRNG for any random choices made for a build, so everything
+// can be reproduced from the seed
+func NewPRNG(seed string) *insecureRand.Rand {
+	digest := sha256.Sum256([]byte(seed))
+	return insecureRand.New(insecureRand.NewSource(int64(binary.LittleEndian.Uint64(digest[:8]))))
+}
+
+// ForFile - A copy of obfArgs with a seed derived from the build's seed and
+// the file name, so each file is obfuscated differently but reproducibly
+func (o *ObfArgs) ForFile(fileName string) *ObfArgs {
+	fileArgs := *o
+	if o.AESSeed != "" {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", o.AESSeed, filepath.Base(fileName))))
+		fileArgs.AESSeed = fmt.Sprintf("%x", digest)
+	}
+	return &fileArgs
+}
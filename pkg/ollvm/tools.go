@@ -0,0 +1,93 @@
+package ollvm
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Archive - Create a static library from objects with llvm-ar (or the
+// target's ar)
+func (c *Clang) Archive(wd string, output string, objs []string) ([]byte, []byte, error) {
+	names := []string{"llvm-ar"}
+	if c.Triple != "" {
+		names = append(names, fmt.Sprintf("%s-ar", c.Triple))
+	}
+	names = append(names, "ar")
+	ar := ""
+	for _, name := range names {
+		if ar = c.findTool(name); ar != "" {
+			break
+		}
+	}
+	if ar == "" {
+		return []byte{}, []byte{}, fmt.Errorf("Could not find an archiver (tried %s)", strings.Join(names, ", "))
+	}
+	args := []string{"rcs", output}
+	args = append(args, objs...)
+	return c.toolCmd(ar, wd, args)
+}
+
+// LinkBitcode - Merge bitcode modules into one with llvm-link
+func (c *Clang) LinkBitcode(wd string, output string, modules []string) ([]byte, []byte, error) {
+	llvmLink := c.findTool("llvm-link")
+	if llvmLink == "" {
+		return []byte{}, []byte{}, fmt.Errorf("Toolchain (%s) has no llvm-link, which is required for whole-program builds", c.flavor())
+	}
+	args := []string{"-o", output}
+	args = append(args, modules...)
+	return c.toolCmd(llvmLink, wd, args)
+}
+
+// LinkerHelp - The --help of the linker clang uses for the target and flags
+func (c *Clang) LinkerHelp(wd string, flags []string) (string, error) {
+	args := append(append([]string{}, flags...), "-Wl,--help")
+	stdout, stderr, err := c.Compile(wd, args)
+	if err != nil {
+		return "", fmt.Errorf("Failed to run the linker (%s) %s", err, stderr)
+	}
+	return string(stdout) + string(stderr), nil
+}
+
+// HasTool - Check if a tool is on the toolchain's PATH
+func (c *Clang) HasTool(name string) bool {
+	return c.findTool(name) != ""
+}
+
+// findTool - Look up an executable on the toolchain's PATH
+func (c *Clang) findTool(name string) string {
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	env, err := c.env()
+	if err != nil {
+		return ""
+	}
+	for _, envVar := range env {
+		if !strings.HasPrefix(envVar, "PATH=") {
+			continue
+		}
+		for _, dir := range filepath.SplitList(strings.TrimPrefix(envVar, "PATH=")) {
+			toolPath := filepath.Join(dir, name)
+			if info, err := os.Stat(toolPath); err == nil && !info.IsDir() {
+				return toolPath
+			}
+		}
+	}
+	return ""
+}
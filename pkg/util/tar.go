@@ -7,6 +7,12 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+)
+
+var (
+	// Progress - Where extraction progress is displayed
+	Progress io.Writer = os.Stdout
 )
 
 // Untar takes a destination path and a reader; a tar reader loops over the tarfile
@@ -21,6 +27,15 @@ func Untar(dst string, r io.Reader) error {
 
 	tr := tar.NewReader(gzr)
 
+	// Symlinks are checked against the real path, dst may itself be a link
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	realDst, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return err
+	}
+
 	for {
 		header, err := tr.Next()
 
@@ -28,7 +43,7 @@ func Untar(dst string, r io.Reader) error {
 
 		// if no more files are found return
 		case err == io.EOF:
-			fmt.Printf("\r\x1b[2K")
+			fmt.Fprintf(Progress, "\r\x1b[2K")
 			return nil
 
 		// return any other error
@@ -40,14 +55,18 @@ func Untar(dst string, r io.Reader) error {
 			continue
 		}
 
-		// the target location where the dir/file should be created
+		// the target location where the dir/file should be created, nothing
+		// may be written outside of dst
 		target := filepath.Join(dst, header.Name)
+		if !IsWithinDir(dst, target) {
+			return fmt.Errorf("Archive entry %s is outside of %s", header.Name, dst)
+		}
 
 		// the following switch could also be done using fi.Mode(), not sure if there
 		// a benefit of using one vs. the other.
 		// fi := header.FileInfo()
 
-		fmt.Printf("\r\x1b[2K%s", target)
+		fmt.Fprintf(Progress, "\r\x1b[2K%s", target)
 
 		// check the file type
 		switch header.Typeflag {
@@ -62,6 +81,9 @@ func Untar(dst string, r io.Reader) error {
 
 		// if it's a file create it
 		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
 			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
 			if err != nil {
 				return err
@@ -75,6 +97,56 @@ func Untar(dst string, r io.Reader) error {
 			// manually close here after each file operation; defering would cause each file close
 			// to wait until all operations have completed.
 			f.Close()
+
+		// llvm builds for unix link the versioned binaries (e.g. clang -> clang-9)
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := checkSymlink(realDst, target, header.Linkname); err != nil {
+				return err
+			}
+			if _, err := os.Lstat(target); err == nil {
+				os.Remove(target)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkSymlink - A symlink must be relative and point inside dst. The link is
+// resolved from the real path of its directory, and ".." may only lead the
+// link so it can't climb back out through another link (e.g. a link to ".")
+func checkSymlink(realDst string, target string, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") || filepath.VolumeName(linkname) != "" {
+		return fmt.Errorf("Archive symlink %s has an absolute target %s", target, linkname)
+	}
+	leading := true
+	for _, element := range strings.Split(filepath.ToSlash(linkname), "/") {
+		if element == ".." && !leading {
+			return fmt.Errorf("Archive symlink %s target %s has '..' after a directory", target, linkname)
+		}
+		if element != ".." && element != "." && element != "" {
+			leading = false
 		}
 	}
+	realParent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if !IsWithinDir(realDst, filepath.Join(realParent, filepath.FromSlash(linkname))) {
+		return fmt.Errorf("Archive symlink %s target %s is outside of the archive", target, linkname)
+	}
+	return nil
+}
+
+// IsWithinDir - Is the (cleaned) path dir or inside of dir
+func IsWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
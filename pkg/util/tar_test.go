@@ -0,0 +1,105 @@
+package util
+
+/*
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type tarEntry struct {
+	Name     string
+	Linkname string
+	Data     string
+}
+
+func testTarball(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.Data))}
+		if entry.Linkname != "" {
+			header = &tar.Header{Name: entry.Name, Linkname: entry.Linkname, Mode: 0777, Typeflag: tar.TypeSymlink}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.Data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gzw.Close()
+	return buf
+}
+
+func TestUntar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	Progress = ioutil.Discard
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		ok      bool
+	}{
+		{
+			name: "toolchain",
+			entries: []tarEntry{
+				{Name: "build/bin/clang-9", Data: "clang"},
+				{Name: "build/bin/clang", Linkname: "clang-9"},
+				{Name: "build/lib/libLLVM.so", Linkname: "../bin/clang-9"},
+			},
+			ok: true,
+		},
+		{name: "traversal", entries: []tarEntry{{Name: "../escaped", Data: "x"}}},
+		{name: "nested traversal", entries: []tarEntry{{Name: "build/../../escaped", Data: "x"}}},
+		{name: "absolute symlink", entries: []tarEntry{{Name: "build/passwd", Linkname: "/etc/passwd"}}},
+		{name: "symlink outside", entries: []tarEntry{{Name: "build/up", Linkname: "../.."}}},
+		{
+			name: "symlink through symlink",
+			entries: []tarEntry{
+				{Name: "here", Linkname: "."},
+				{Name: "out", Linkname: "here/../escaped"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "denim-untar-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			dst := filepath.Join(parent, "dst")
+			err = Untar(dst, testTarball(t, test.entries))
+			if test.ok && err != nil {
+				t.Fatalf("Untar() error: %s", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("Untar() extracted an unsafe archive")
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escaped")); err == nil {
+				t.Fatalf("Untar() wrote outside of dst")
+			}
+		})
+	}
+}
@@ -35,7 +35,10 @@ func Unzip(src string, dest string) ([]string, error) {
 		defer rc.Close()
 
 		fPath := filepath.Join(dest, file.Name)
-		fmt.Printf("\r\x1b[2K%s", fPath)
+		if !IsWithinDir(dest, fPath) {
+			return filenames, fmt.Errorf("Archive entry %s is outside of %s", file.Name, dest)
+		}
+		fmt.Fprintf(Progress, "\r\x1b[2K%s", fPath)
 		filenames = append(filenames, fPath)
 
 		if file.FileInfo().IsDir() {
@@ -56,6 +59,6 @@ func Unzip(src string, dest string) ([]string, error) {
 			}
 		}
 	}
-	fmt.Printf("\r\x1b[2K")
+	fmt.Fprintf(Progress, "\r\x1b[2K")
 	return filenames, nil
 }